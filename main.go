@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	flags "github.com/jessevdk/go-flags"
@@ -13,39 +17,272 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
+	"github.com/thought-machine/conntest/src/config"
+	"github.com/thought-machine/conntest/src/discovery"
+	"github.com/thought-machine/conntest/src/grpcconn"
+	"github.com/thought-machine/conntest/src/httpconn"
+	"github.com/thought-machine/conntest/src/kubediscovery"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/pmtu"
+	"github.com/thought-machine/conntest/src/scheduler"
 	"github.com/thought-machine/conntest/src/srvendpoints"
+	"github.com/thought-machine/conntest/src/suites"
 	"github.com/thought-machine/conntest/src/tcpconn"
+	"github.com/thought-machine/conntest/src/testplan"
+	"github.com/thought-machine/conntest/src/udpconn"
 )
 
 var log = logrus.New()
 
 var opts struct {
-	HostPort         string  `long:"host_port" default:"8080" description:"Port to host on"`
-	DestHost         string  `long:"dst_hst" default:"localhost:8080" description:"Destination host to target for tests"`
-	TimeBetTests     float64 `long:"wait_time" default:"5" description:"Minimum time between individual tests"`
-	RandTimeTest     float64 `long:"rand_secs" default:"5.0" description:"Maximum random time to be added to TimeBetTests"`
-	ShortTestBytes   int     `long:"short_test_bytes" default:"10" description:"Bytes to use for short tests"`
-	LongTestBytes    int     `long:"long_test_bytes" default:"10000" description:"Bytes to use for long tests"`
-	TimesToSend      int     `long:"times_to_send" default:"0" description:"Number of times to send bytes"`
-	DNSRetryInterval float64 `long:"DNS_retry_interval" default:"5.0" description:"Time between attempts to re-discover SRV records"`
-	MaxDNSRetries    int     `long:"max_DNS_retries" default:"-1" description:"Maximum number of retries when attmpting to re-discover SRV records, use -1 for infinite retries"`
-	PromPort         string  `long:"prom_port" default:"9990" description:"Port to host prometheus metrics on"`
-	NodeName         string  `long:"nodename" default:"None" description:"If None, uses NODE_NAME from environment for its node name, otherwise uses this argument"`
+	Config             string    `long:"config" description:"YAML or JSON file of named test suites to run, the test flags below are the defaults of every suite. Suite labels are only exported on conntest_suite_info"`
+	ConfigInterval     float64   `long:"config_interval" default:"10.0" description:"Seconds between checking whether the config file has changed, it is also reloaded on SIGHUP"`
+	Suite              string    `long:"suite" default:"default" description:"Name of the suite made of the test flags when there is no config file"`
+	HostPort           string    `long:"host_port" default:"8080" description:"Port to host on"`
+	HTTPPort           string    `long:"http_port" default:"8081" description:"Port to host HTTP tests on"`
+	GRPCPort           string    `long:"grpc_port" default:"8082" description:"Port to host gRPC tests on"`
+	UDPPort            string    `long:"udp_port" default:"8083" description:"Port to host UDP tests on"`
+	Protocol           string    `long:"protocol" default:"tcp" choice:"tcp" choice:"tcp_persistent" choice:"tcp_idle" choice:"http" choice:"grpc" choice:"udp" choice:"pmtu" description:"Protocol to send tests with, tcp_persistent pings one connection kept open to each peer, tcp_idle finds how long connections to each peer can idle for and pmtu discovers the path MTU to each peer's UDP port"`
+	TCPMode            string    `long:"tcp_mode" default:"ack" choice:"ack" choice:"echo" choice:"server_sends" description:"Which way TCP tests carry their data: to the peer which only ACKs it, to the peer and echoed back, or sent by the peer"`
+	GRPCMessages       int       `long:"grpc_messages" default:"10" description:"Number of test sized messages to send on each gRPC stream"`
+	UDPPackets         int       `long:"udp_packets" default:"100" description:"Number of datagrams to send to each peer per UDP test"`
+	UDPInterval        float64   `long:"udp_interval" default:"0.01" description:"Time between datagrams in a UDP test"`
+	Discovery          string    `long:"discovery" default:"srv" choice:"srv" choice:"static" choice:"dns" choice:"file" choice:"kubernetes" description:"How to discover peers: SRV records of srv_name, the comma separated dst_hst list, every A/AAAA record of dst_hst, the lines of discovery_file, or by watching the EndpointSlices of k8s_service"`
+	SRVName            string    `long:"srv_name" default:"conntest" description:"Name to look up SRV records of, the service and protocol come from the protocol being tested"`
+	DestHost           string    `long:"dst_hst" default:"localhost:8080" description:"Destination host(s) to target for tests with static or dns discovery"`
+	DiscoveryFile      string    `long:"discovery_file" description:"File with one host:port per line to target for tests with file discovery"`
+	K8sService         string    `long:"k8s_service" default:"conntest" description:"Service to watch the EndpointSlices of with kubernetes discovery"`
+	K8sNamespace       string    `long:"k8s_namespace" default:"None" description:"Namespace of k8s_service, if None uses POD_NAMESPACE from environment"`
+	TimeBetTests       float64   `long:"wait_time" default:"5" description:"Minimum time between individual tests"`
+	RandTimeTest       float64   `long:"rand_secs" default:"5.0" description:"Maximum random time to be added to TimeBetTests"`
+	ShortTestBytes     int       `long:"short_test_bytes" default:"10" description:"Bytes to use for short tests"`
+	LongTestBytes      int       `long:"long_test_bytes" default:"10000" description:"Bytes to use for long tests"`
+	LongTestEvery      int       `long:"long_test_every" default:"2" description:"Send a long test every this many tests to a peer and short tests otherwise, use 0 to only send short tests"`
+	TimesToSend        int       `long:"times_to_send" default:"0" description:"Number of tests to send to each peer, use 0 to send forever"`
+	DiscoveryInterval  float64   `long:"discovery_interval" default:"5.0" description:"Seconds between looking for added and removed peers"`
+	MaxConcurrentTests int       `long:"max_concurrent_tests" default:"50" description:"Most tests of a suite to have in flight at once across all peers, use 0 for no limit"`
+	StaleSeriesTTL     float64   `long:"stale_series_ttl" default:"300.0" description:"Seconds after a peer disappears from discovery, or a client stops connecting, to delete its metrics"`
+	ShutdownTimeout    float64   `long:"shutdown_timeout" default:"10.0" description:"Seconds to let tests in flight finish for after SIGTERM before cancelling them"`
+	ConnectTimeout     float64   `long:"connect_timeout" default:"5.0" description:"Seconds to wait for a connection to a peer, use 0 to wait forever"`
+	ReadTimeout        float64   `long:"read_timeout" default:"5.0" description:"Seconds to wait for each reply from a peer, use 0 to wait forever"`
+	WriteTimeout       float64   `long:"write_timeout" default:"5.0" description:"Seconds to wait for each write to a peer, use 0 to wait forever"`
+	TestTimeout        float64   `long:"test_timeout" default:"0" description:"Longest a whole test may take, use 0 for no limit"`
+	MaxRequestBytes    int       `long:"max_request_bytes" default:"4194304" description:"Largest test in bytes to serve, bigger ones are rejected"`
+	ServerIdleTimeout  float64   `long:"server_idle_timeout" default:"7200.0" description:"Seconds a served connection may go without a test before it is closed, longer than any peer's idle_durations"`
+	IdleDurations      []float64 `long:"idle_durations" default:"30" default:"300" default:"900" default:"3600" description:"Seconds tcp_idle tests leave a connection idle for, repeat for each connection to open"`
+	DNSRetryInterval   float64   `long:"DNS_retry_interval" default:"5.0" description:"Time between attempts to re-discover SRV records"`
+	MaxDNSRetries      int       `long:"max_DNS_retries" default:"-1" description:"Maximum number of retries when attmpting to re-discover SRV records, use -1 for infinite retries"`
+	PromPort           string    `long:"prom_port" default:"9990" description:"Port to host prometheus metrics on"`
+	NodeName           string    `long:"nodename" default:"None" description:"If None, uses NODE_NAME from environment for its node name, otherwise uses this argument"`
+	PodName            string    `long:"podname" default:"None" description:"If None, uses POD_NAME from environment for its pod name, otherwise uses this argument"`
+	Zone               string    `long:"zone" default:"None" description:"If None, looks up the zone from the topology labels of the k8s node, otherwise uses this argument"`
 }
 
 func init() {
+	// Per peer metrics are registered through peer so that the series of peers that have gone can be deleted
 	prometheus.MustRegister(tcpconn.ConnsHandledTotal)
-	prometheus.MustRegister(tcpconn.RetransmitsCounterVec)
-	prometheus.MustRegister(tcpconn.SndMssGaugeVec)
-	prometheus.MustRegister(tcpconn.RcvMssGaugeVec)
-	prometheus.MustRegister(tcpconn.LostPacketsCounterVec)
-	prometheus.MustRegister(tcpconn.RetransCounterVec)
-	prometheus.MustRegister(tcpconn.PmtuGaugeVec)
-	prometheus.MustRegister(tcpconn.RttGaugeVec)
-	prometheus.MustRegister(tcpconn.RttHistVec)
-	prometheus.MustRegister(tcpconn.RttVarGaugeVec)
-	prometheus.MustRegister(tcpconn.TotalRetransGaugeVec)
-	prometheus.MustRegister(srvendpoints.TotalFailedSRVCounter)
+	prometheus.MustRegister(tcpconn.HostAddressesGaugeVec)
+	peer.MustRegister(tcpconn.RetransmitsCounterVec)
+	peer.MustRegister(tcpconn.SndMssGaugeVec)
+	peer.MustRegister(tcpconn.RcvMssGaugeVec)
+	peer.MustRegister(tcpconn.LostPacketsCounterVec)
+	peer.MustRegister(tcpconn.RetransCounterVec)
+	peer.MustRegister(tcpconn.PmtuGaugeVec)
+	peer.MustRegister(tcpconn.RttGaugeVec)
+	peer.MustRegister(tcpconn.RttHistVec)
+	peer.MustRegister(tcpconn.RttVarGaugeVec)
+	peer.MustRegister(tcpconn.TotalRetransGaugeVec)
+	peer.MustRegister(tcpconn.DialHistVec)
+	peer.MustRegister(tcpconn.PayloadRttHistVec)
+	peer.MustRegister(tcpconn.TransferHistVec)
+	peer.MustRegister(tcpconn.ThroughputGaugeVec)
+	peer.MustRegister(tcpconn.PingHistVec)
+	peer.MustRegister(tcpconn.ConnectionAgeGaugeVec)
+	peer.MustRegister(tcpconn.LifetimeHistVec)
+	peer.MustRegister(tcpconn.RetransDeltaGaugeVec)
+	peer.MustRegister(tcpconn.LostDeltaGaugeVec)
+	peer.MustRegister(tcpconn.RttDeltaGaugeVec)
+	peer.MustRegisterClients(tcpconn.ServerRetransmitsCounterVec)
+	peer.MustRegisterClients(tcpconn.ServerRcvMssGaugeVec)
+	peer.MustRegisterClients(tcpconn.ServerRttGaugeVec)
+	peer.MustRegisterClients(tcpconn.ServerRttHistVec)
+	peer.MustRegisterClients(tcpconn.ServerCorruptPayloadsCounterVec)
+	peer.MustRegister(tcpconn.CorruptPayloadsCounterVec)
+	peer.MustRegisterClients(tcpconn.ClientConnsCounterVec)
+	peer.MustRegisterClients(tcpconn.NATGaugeVec)
+	peer.MustRegister(tcpconn.PeerVersionGaugeVec)
+	prometheus.MustRegister(httpconn.RequestsHandledTotal)
+	peer.MustRegister(httpconn.DNSGaugeVec)
+	peer.MustRegister(httpconn.ConnectGaugeVec)
+	peer.MustRegister(httpconn.TLSGaugeVec)
+	peer.MustRegister(httpconn.FirstByteGaugeVec)
+	peer.MustRegister(httpconn.TotalGaugeVec)
+	peer.MustRegister(httpconn.TotalHistVec)
+	peer.MustRegister(httpconn.ResponseCounterVec)
+	prometheus.MustRegister(grpcconn.RPCsHandledTotal)
+	peer.MustRegister(grpcconn.RPCLatencyHistVec)
+	peer.MustRegister(grpcconn.RPCStatusCounterVec)
+	prometheus.MustRegister(udpconn.PacketsHandledTotal)
+	peer.MustRegister(udpconn.LossGaugeVec)
+	peer.MustRegister(udpconn.DuplicatesCounterVec)
+	peer.MustRegister(udpconn.ReorderedCounterVec)
+	peer.MustRegister(udpconn.JitterGaugeVec)
+	peer.MustRegister(udpconn.RttHistVec)
+	peer.MustRegister(pmtu.DiscoveredPmtuGaugeVec)
+	peer.MustRegister(pmtu.InterfaceMtuGaugeVec)
+	peer.MustRegister(pmtu.MismatchGaugeVec)
+	prometheus.MustRegister(discovery.TotalFailedSRVCounter)
+	peer.MustRegister(srvendpoints.ProbeFailuresCounterVec)
+	peer.MustRegister(srvendpoints.ProbeSuccessesCounterVec)
+	peer.MustRegister(srvendpoints.ConnectionDeathsHistVec)
+	peer.MustRegister(srvendpoints.IdleSurvivedGaugeVec)
+	peer.MustRegister(srvendpoints.MaxIdleGaugeVec)
+	prometheus.MustRegister(scheduler.TargetsGaugeVec)
+	prometheus.MustRegister(scheduler.TestsInFlightGauge)
+	prometheus.MustRegister(config.HashGaugeVec)
+	prometheus.MustRegister(config.LastReloadSuccessGauge)
+	prometheus.MustRegister(config.LastReloadTimestampGauge)
+	prometheus.MustRegister(config.ReloadsCounterVec)
+}
+
+// srvServices maps each protocol to the service and protocol of its SRV record
+var srvServices = map[string][2]string{
+	"tcp":            {"tcp", "tcp"},
+	"tcp_persistent": {"tcp", "tcp"},
+	"tcp_idle":       {"tcp", "tcp"},
+	"http":           {"http", "tcp"},
+	"grpc":           {"grpc", "tcp"},
+	"udp":            {"udp", "udp"},
+	"pmtu":           {"udp", "udp"},
+}
+
+// flagSuite is the suite set by the test flags
+func flagSuite() config.Suite {
+	return config.Suite{
+		Name:               opts.Suite,
+		Protocol:           opts.Protocol,
+		TCPMode:            opts.TCPMode,
+		GRPCMessages:       opts.GRPCMessages,
+		UDPPackets:         opts.UDPPackets,
+		Discovery:          opts.Discovery,
+		SRVName:            opts.SRVName,
+		DestHost:           opts.DestHost,
+		DiscoveryFile:      opts.DiscoveryFile,
+		K8sService:         opts.K8sService,
+		K8sNamespace:       opts.K8sNamespace,
+		ShortTestBytes:     opts.ShortTestBytes,
+		LongTestBytes:      opts.LongTestBytes,
+		LongTestEvery:      opts.LongTestEvery,
+		TimesToSend:        opts.TimesToSend,
+		UDPInterval:        opts.UDPInterval,
+		TimeBetTests:       opts.TimeBetTests,
+		RandTimeTest:       opts.RandTimeTest,
+		ConnectTimeout:     opts.ConnectTimeout,
+		ReadTimeout:        opts.ReadTimeout,
+		WriteTimeout:       opts.WriteTimeout,
+		TestTimeout:        opts.TestTimeout,
+		IdleDurations:      opts.IdleDurations,
+		MaxConcurrentTests: opts.MaxConcurrentTests,
+	}
+}
+
+// newDiscoverer sets up peer discovery as chosen by the suite, until ctx is done
+func newDiscoverer(ctx context.Context, suite config.Suite) (discovery.Discoverer, error) {
+	switch suite.Discovery {
+	case "static":
+		return discovery.NewStaticDiscoverer(suite.DestHost), nil
+	case "dns":
+		return discovery.NewDNSDiscoverer(suite.DestHost)
+	case "file":
+		return &discovery.FileDiscoverer{Path: suite.DiscoveryFile}, nil
+	case "kubernetes":
+		namespace := suite.K8sNamespace
+		if namespace == "None" {
+			envNamespace, found := os.LookupEnv("POD_NAMESPACE")
+			if !found {
+				return nil, errors.New("POD_NAMESPACE not discovered from the environment")
+			}
+			namespace = envNamespace
+		}
+		// Ports in the service are named after the SRV service of each protocol
+		w, err := kubediscovery.NewInClusterWatcher(namespace, suite.K8sService, srvServices[suite.Protocol][0])
+		if err != nil {
+			return nil, err
+		}
+		// Watches for as long as the suite runs
+		return w, w.Start(ctx.Done())
+	default:
+		srv := srvServices[suite.Protocol]
+		return &discovery.SRVDiscoverer{
+			Service:           srv[0],
+			Protocol:          srv[1],
+			Name:              suite.SRVName,
+			RetryIntervalSecs: opts.DNSRetryInterval,
+			MaxRetries:        opts.MaxDNSRetries,
+		}, nil
+	}
+}
+
+// newSender picks how to send the tests of the suite, along with how to release what it keeps for a peer if anything
+func newSender(suite config.Suite) (srvendpoints.SendFunc, func(peer.Peer)) {
+	timeouts := tcpconn.Timeouts{
+		Connect: time.Duration(1e9 * suite.ConnectTimeout),
+		Read:    time.Duration(1e9 * suite.ReadTimeout),
+		Write:   time.Duration(1e9 * suite.WriteTimeout),
+	}
+	switch suite.Protocol {
+	case "tcp_persistent":
+		sender := &srvendpoints.PersistentSender{Timeouts: timeouts}
+		return sender.Send, sender.Release
+	case "tcp_idle":
+		idle := make([]time.Duration, len(suite.IdleDurations))
+		for i, d := range suite.IdleDurations {
+			idle[i] = time.Duration(1e9 * d)
+		}
+		return srvendpoints.IdleSender(timeouts, idle), nil
+	case "http":
+		return srvendpoints.HTTPSender(timeouts), nil
+	case "grpc":
+		return srvendpoints.GRPCSender(timeouts, suite.GRPCMessages), nil
+	case "udp":
+		return srvendpoints.UDPSender(suite.UDPPackets, suite.UDPInterval), nil
+	case "pmtu":
+		return srvendpoints.PMTUSender(), nil
+	default:
+		return srvendpoints.TCPSender(timeouts, tcpconn.Mode(suite.TCPMode)), nil
+	}
+}
+
+// newScheduler sets up the tests of the suite, sent from local until ctx is done
+func newScheduler(ctx context.Context, suite config.Suite, local peer.Peer) (*scheduler.Scheduler, error) {
+	d, err := newDiscoverer(ctx, suite)
+	if err != nil {
+		return nil, fmt.Errorf("Suite %v: %w", suite.Name, err)
+	}
+	local.Suite = suite.Name
+	send, release := newSender(suite)
+	// Repeatedly send messages of the size the plan picks to every peer, each on its own schedule
+	// with time intervals plus a random amount up to that specified by suite.RandTimeTest
+	return &scheduler.Scheduler{
+		Discoverer: d,
+		Local:      local,
+		Send:       send,
+		Release:    release,
+		Plan: testplan.Plan{
+			ShortBytes: suite.ShortTestBytes,
+			LongBytes:  suite.LongTestBytes,
+			LongEvery:  suite.LongTestEvery,
+		},
+		Cycles: suite.TimesToSend,
+		Wait: func() time.Duration {
+			// Only understands nanoseconds
+			return time.Duration(1e9 * (suite.TimeBetTests + (suite.RandTimeTest * rand.Float64())))
+		},
+		DiscoveryInterval: time.Duration(1e9 * opts.DiscoveryInterval),
+		MaxConcurrent:     suite.MaxConcurrentTests,
+		StaleSeriesTTL:    time.Duration(1e9 * opts.StaleSeriesTTL),
+		TestTimeout:       time.Duration(1e9 * suite.TestTimeout),
+	}, nil
 }
 
 func main() {
@@ -56,6 +293,51 @@ func main() {
 		fmt.Printf("\n%s\n", err)
 		os.Exit(1)
 	}
+	// A ticker can't tick every 0 seconds
+	if opts.Config != "" && opts.ConfigInterval <= 0 {
+		fmt.Printf("\n--config_interval must be more than 0, not %v\n", opts.ConfigInterval)
+		os.Exit(1)
+	}
+
+	// Look up node name
+	var nodeName string
+	if opts.NodeName == "None" {
+		envNodeName, foundBool := os.LookupEnv("NODE_NAME")
+		if foundBool != true {
+			log.Fatal("NODE_NAME not discovered from the enviroment")
+		}
+		nodeName = envNodeName
+	} else {
+		nodeName = opts.NodeName
+	}
+	log.Infof("Using %v as the name of the k8s node", nodeName)
+
+	// Look up zone, not knowing it only costs us a label
+	zone := opts.Zone
+	if zone == "None" {
+		zone, err = kubediscovery.InClusterNodeZone(nodeName)
+		if err != nil {
+			log.Warning("Could not look up the zone of the k8s node: ", err)
+		}
+	}
+	log.Infof("Using %v as the zone of the k8s node", zone)
+	local := peer.Peer{NodeName: nodeName, SrcZone: zone}
+
+	// Look up pod name, only used to tell peers who we are
+	podName := opts.PodName
+	if podName == "None" {
+		podName = os.Getenv("POD_NAME")
+	}
+	tcpconn.Identity = tcpconn.Hello{NodeName: nodeName, PodName: podName, Zone: zone}
+	// Only an info metric, so carry on without it
+	if err := tcpconn.RecordHostAddresses(); err != nil {
+		log.Warning(err)
+	}
+	tcpconn.ClientTimeouts = tcpconn.Timeouts{
+		Connect: time.Duration(1e9 * opts.ConnectTimeout),
+		Read:    time.Duration(1e9 * opts.ReadTimeout),
+		Write:   time.Duration(1e9 * opts.WriteTimeout),
+	}
 
 	// Binding to all interfaces
 	addr := ":" + opts.HostPort
@@ -68,36 +350,116 @@ func main() {
 	defer s.Close()
 
 	// Means that we can stack up multiple servers/clients
-	go tcpconn.DealWithTCPConnections(s)
+	go tcpconn.DealWithTCPConnectionsWithin(s, tcpconn.ServerLimits{
+		MaxRequestBytes: opts.MaxRequestBytes,
+		// Served connections are bounded by the same timeouts as the tests we send
+		Timeouts: tcpconn.Timeouts{
+			Read:  time.Duration(1e9 * opts.ReadTimeout),
+			Write: time.Duration(1e9 * opts.WriteTimeout),
+		},
+		Idle: time.Duration(1e9 * opts.ServerIdleTimeout),
+	})
+
+	// Always serve every protocol so that peers can choose any of them
+	hs, err := net.Listen("tcp", ":"+opts.HTTPPort)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer hs.Close()
+
+	go httpconn.DealWithHTTPConnections(hs)
+
+	gs, err := net.Listen("tcp", ":"+opts.GRPCPort)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer gs.Close()
+
+	go grpcconn.DealWithGRPCConnections(gs)
+
+	us, err := net.ListenPacket("udp", ":"+opts.UDPPort)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer us.Close()
+
+	go udpconn.DealWithUDPConnections(us)
 
 	// Serves Prometheus metrics
 	http.Handle("/metrics", promhttp.Handler())
 	promAddr := ":" + opts.PromPort
 	go http.ListenAndServe(promAddr, nil)
 
-	// Look up node name
-	var nodeName string
-	if opts.NodeName == "None" {
-		envNodeName, foundBool := os.LookupEnv("NODE_NAME")
-		if foundBool != true {
-			log.Fatal("NODE_NAME not discovered from the enviroment")
+	// On SIGTERM stop starting tests, but give the ones in flight up to opts.ShutdownTimeout to finish
+	// so that peers aren't left with half finished tests
+	ctx, stop := context.WithCancel(context.Background())
+	testCtx, cancelTests := context.WithCancel(context.Background())
+	defer cancelTests()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Info("Received ", sig, ", finishing tests in flight")
+		stop()
+		time.Sleep(time.Duration(1e9 * opts.ShutdownTimeout))
+		log.Warning("Tests still running after ", opts.ShutdownTimeout, " seconds, cancelling them")
+		cancelTests()
+	}()
+
+	// Clients that stop testing us are forgotten like peers that disappear
+	go peer.ForgetStaleClients(ctx, time.Duration(1e9*opts.StaleSeriesTTL), time.Duration(1e9*opts.DiscoveryInterval))
+
+	// Every suite runs on its own schedule, so a slow suite doesn't hold up the others
+	manager := &suites.Manager{
+		New: func(ctx context.Context, suite config.Suite) (*scheduler.Scheduler, error) {
+			return newScheduler(ctx, suite, local)
+		},
+	}
+	var info prometheus.Collector
+	apply := func(ss []config.Suite) error {
+		if err := manager.Apply(ctx, testCtx, ss); err != nil {
+			return err
 		}
-		nodeName = envNodeName
-	} else {
-		nodeName = opts.NodeName
+		// Suites can add and remove labels, so the info metric is replaced rather than updated
+		if info != nil {
+			prometheus.Unregister(info)
+		}
+		info = config.InfoGaugeVec(ss)
+		prometheus.MustRegister(info)
+		return nil
 	}
-	log.Infof("Using %v as the name of the k8s node", nodeName)
-
-	// Repeatedly send messages of specified size to the server
-	// with time intervals plus a random amount up to that specified by opts.RandTimeTest
-	for {
-		err = srvendpoints.SendConcTCPConnections("tcp", "tcp", "conntest", nodeName, opts.ShortTestBytes, opts.DNSRetryInterval, opts.MaxDNSRetries)
-		if err != nil {
-			log.Error(err)
+	if opts.Config == "" {
+		ss := []config.Suite{flagSuite()}
+		if err := config.Validate(ss); err != nil {
+			log.Fatal(err)
+		}
+		if err := apply(ss); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		// Suites are changed in place when the config changes, so that counters aren't reset by restarting
+		w := &config.Watcher{
+			Path:     opts.Config,
+			Defaults: flagSuite(),
+			Interval: time.Duration(1e9 * opts.ConfigInterval),
+			Apply:    apply,
+		}
+		if err := w.Load(); err != nil {
+			log.Fatal(err)
 		}
-		// Only understands nanoseconds
-		ti := int64(1e9 * (opts.TimeBetTests + (opts.RandTimeTest * rand.Float64())))
-		log.Debug("Total time between tests: ", float64(ti)/float64(1e9), " seconds")
-		time.Sleep(time.Duration(ti))
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go w.Run(ctx, reload)
+		// A reload can add suites whenever, even once the ones running have sent all their tests
+		<-ctx.Done()
 	}
+	manager.Wait()
+	// Listeners are closed on the way out
+	log.Info("Finished sending tests, shutting down")
 }
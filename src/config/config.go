@@ -0,0 +1,255 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thought-machine/conntest/src/peer"
+)
+
+// Protocols that a suite can send tests with
+var Protocols = []string{"tcp", "tcp_persistent", "tcp_idle", "http", "grpc", "udp", "pmtu"}
+
+// Discoveries are the ways a suite can find its peers
+var Discoveries = []string{"srv", "static", "dns", "file", "kubernetes"}
+
+// TCPModes are the ways TCP tests can carry their data
+var TCPModes = []string{"ack", "echo", "server_sends"}
+
+// ignoredKeys are the keys that each protocol has no use for, which suites of it can't set
+var ignoredKeys = map[string][]string{
+	// Datagrams have no connection to time out, only replies that never come which they count as lost
+	"udp":  {"connect_timeout", "read_timeout", "write_timeout"},
+	"pmtu": {"connect_timeout", "read_timeout", "write_timeout"},
+}
+
+var (
+	suiteName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Suite is one shape of test sent to one set of peers, its keys are named after the flags that set them when
+// there is no config file. Times are in seconds
+type Suite struct {
+	Name          string `yaml:"name"`
+	Protocol      string `yaml:"protocol"`
+	TCPMode       string `yaml:"tcp_mode"`
+	GRPCMessages  int    `yaml:"grpc_messages"`
+	UDPPackets    int    `yaml:"udp_packets"`
+	Discovery     string `yaml:"discovery"`
+	SRVName       string `yaml:"srv_name"`
+	DestHost      string `yaml:"dst_hst"`
+	DiscoveryFile string `yaml:"discovery_file"`
+	K8sService    string `yaml:"k8s_service"`
+	K8sNamespace  string `yaml:"k8s_namespace"`
+
+	ShortTestBytes int `yaml:"short_test_bytes"`
+	LongTestBytes  int `yaml:"long_test_bytes"`
+	LongTestEvery  int `yaml:"long_test_every"`
+	TimesToSend    int `yaml:"times_to_send"`
+
+	UDPInterval    float64 `yaml:"udp_interval"`
+	TimeBetTests   float64 `yaml:"wait_time"`
+	RandTimeTest   float64 `yaml:"rand_secs"`
+	ConnectTimeout float64 `yaml:"connect_timeout"`
+	ReadTimeout    float64 `yaml:"read_timeout"`
+	WriteTimeout   float64 `yaml:"write_timeout"`
+	TestTimeout    float64 `yaml:"test_timeout"`
+	// How long tcp_idle tests leave connections idle for
+	IdleDurations []float64 `yaml:"idle_durations"`
+
+	MaxConcurrentTests int `yaml:"max_concurrent_tests"`
+
+	// Extra labels of the suite, which are info only. They are exported on conntest_suite_info and on no other metric
+	Labels map[string]string `yaml:"labels"`
+}
+
+// file is the layout of a config file
+type file struct {
+	Suites []Suite `yaml:"suites"`
+}
+
+// rawFile is file with every suite left undecoded, to only set the keys it has on top of the defaults
+type rawFile struct {
+	Suites []yaml.MapSlice `yaml:"suites"`
+}
+
+// Parse reads the suites in data, which is YAML or JSON, anything a suite leaves out is taken from defaults
+func Parse(data []byte, defaults Suite) ([]Suite, error) {
+	// Decoding the whole file first reports unknown keys and wrong types with the lines they are on
+	var f file
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("Invalid config: %w", err)
+	}
+	if len(f.Suites) == 0 {
+		return nil, errors.New("Invalid config: no suites")
+	}
+	var raw rawFile
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Invalid config: %w", err)
+	}
+	suites := make([]Suite, len(raw.Suites))
+	for i, keys := range raw.Suites {
+		// Each suite is decoded on its own so that it starts from a copy of defaults
+		b, err := yaml.Marshal(keys)
+		if err != nil {
+			return nil, err
+		}
+		suite := defaults
+		suite.Name = ""
+		suite.Labels = nil
+		if err := yaml.UnmarshalStrict(b, &suite); err != nil {
+			return nil, fmt.Errorf("Invalid suite %d: %w", i+1, err)
+		}
+		for _, item := range keys {
+			if key, ok := item.Key.(string); ok && oneOf(key, ignoredKeys[suite.Protocol]) {
+				if suite.Name == "" {
+					return nil, fmt.Errorf("Invalid suite %d: %v doesn't apply to %v suites", i+1, key, suite.Protocol)
+				}
+				return nil, fmt.Errorf("Invalid suite %v: %v doesn't apply to %v suites", suite.Name, key, suite.Protocol)
+			}
+		}
+		suites[i] = suite
+	}
+	return suites, Validate(suites)
+}
+
+// Validate checks every suite makes sense on its own and that their names are unique
+func Validate(suites []Suite) error {
+	names := make(map[string]bool, len(suites))
+	for i, suite := range suites {
+		if err := suite.Validate(); err != nil {
+			if suite.Name == "" {
+				return fmt.Errorf("Invalid suite %d: %w", i+1, err)
+			}
+			return fmt.Errorf("Invalid suite %v: %w", suite.Name, err)
+		}
+		if names[suite.Name] {
+			return fmt.Errorf("Invalid suite %v: name is used by another suite", suite.Name)
+		}
+		names[suite.Name] = true
+	}
+	return nil
+}
+
+// Validate checks that s makes sense, the error says which key is wrong
+func (s Suite) Validate() error {
+	switch {
+	case !suiteName.MatchString(s.Name):
+		return fmt.Errorf("name %q must be made of letters, digits, _ and -", s.Name)
+	case !oneOf(s.Protocol, Protocols):
+		return fmt.Errorf("protocol %q must be one of %v", s.Protocol, strings.Join(Protocols, ", "))
+	case s.Protocol == "tcp" && !oneOf(s.TCPMode, TCPModes):
+		return fmt.Errorf("tcp_mode %q must be one of %v", s.TCPMode, strings.Join(TCPModes, ", "))
+	case !oneOf(s.Discovery, Discoveries):
+		return fmt.Errorf("discovery %q must be one of %v", s.Discovery, strings.Join(Discoveries, ", "))
+	case (s.Discovery == "static" || s.Discovery == "dns") && s.DestHost == "":
+		return fmt.Errorf("dst_hst must be set to use %v discovery", s.Discovery)
+	case s.Discovery == "file" && s.DiscoveryFile == "":
+		return errors.New("discovery_file must be set to use file discovery")
+	case s.Discovery == "kubernetes" && s.K8sService == "":
+		return errors.New("k8s_service must be set to use kubernetes discovery")
+	case s.Discovery == "srv" && s.SRVName == "":
+		return errors.New("srv_name must be set to use srv discovery")
+	case s.ShortTestBytes <= 0:
+		return fmt.Errorf("short_test_bytes must be more than 0, not %v", s.ShortTestBytes)
+	case s.LongTestBytes <= 0:
+		return fmt.Errorf("long_test_bytes must be more than 0, not %v", s.LongTestBytes)
+	case s.LongTestEvery < 0:
+		return errors.New("long_test_every can't be negative")
+	case s.TimesToSend < 0:
+		return errors.New("times_to_send can't be negative")
+	case s.GRPCMessages <= 0:
+		return fmt.Errorf("grpc_messages must be more than 0, not %v", s.GRPCMessages)
+	case s.UDPPackets <= 0:
+		return fmt.Errorf("udp_packets must be more than 0, not %v", s.UDPPackets)
+	case s.MaxConcurrentTests < 0:
+		return errors.New("max_concurrent_tests can't be negative")
+	}
+	times := []struct {
+		key   string
+		value float64
+	}{
+		{"udp_interval", s.UDPInterval},
+		{"wait_time", s.TimeBetTests},
+		{"rand_secs", s.RandTimeTest},
+		{"connect_timeout", s.ConnectTimeout},
+		{"read_timeout", s.ReadTimeout},
+		{"write_timeout", s.WriteTimeout},
+		{"test_timeout", s.TestTimeout},
+	}
+	for _, t := range times {
+		if t.value < 0 {
+			return fmt.Errorf("%v can't be negative", t.key)
+		}
+	}
+	if s.Protocol == "tcp_idle" {
+		if len(s.IdleDurations) == 0 {
+			return errors.New("idle_durations must be set to use tcp_idle")
+		}
+		for _, d := range s.IdleDurations {
+			if d <= 0 {
+				return fmt.Errorf("idle_durations must all be more than 0, not %v", d)
+			}
+			if s.TestTimeout > 0 && d >= s.TestTimeout {
+				return fmt.Errorf("test_timeout must be longer than every idle_durations, not %v", s.TestTimeout)
+			}
+		}
+	}
+	for name := range s.Labels {
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("label %q isn't a valid prometheus label name", name)
+		}
+		if oneOf(name, peer.LabelNames) {
+			return fmt.Errorf("label %q is already set on every metric", name)
+		}
+	}
+	return nil
+}
+
+// oneOf reports whether s is in choices
+func oneOf(s string, choices []string) bool {
+	for _, choice := range choices {
+		if s == choice {
+			return true
+		}
+	}
+	return false
+}
+
+// InfoGaugeVec returns conntest_suite_info set to 1 for every suite, labelled with its name and its extra labels.
+// Suites that don't set a label that another one does get it empty
+func InfoGaugeVec(suites []Suite) *prometheus.GaugeVec {
+	var extra []string
+	seen := make(map[string]bool)
+	for _, suite := range suites {
+		for name := range suite.Labels {
+			if !seen[name] {
+				seen[name] = true
+				extra = append(extra, name)
+			}
+		}
+	}
+	sort.Strings(extra)
+
+	vec := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_suite_info",
+		},
+		append([]string{"suite"}, extra...),
+	)
+	for _, suite := range suites {
+		values := []string{suite.Name}
+		for _, name := range extra {
+			values = append(values, suite.Labels[name])
+		}
+		vec.WithLabelValues(values...).Set(1)
+	}
+	return vec
+}
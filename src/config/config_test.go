@@ -0,0 +1,118 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var defaults = Suite{
+	Name:           "default",
+	Protocol:       "tcp",
+	TCPMode:        "ack",
+	GRPCMessages:   10,
+	UDPPackets:     100,
+	Discovery:      "srv",
+	SRVName:        "conntest",
+	DestHost:       "localhost:8080",
+	K8sService:     "conntest",
+	ShortTestBytes: 10,
+	LongTestBytes:  10000,
+	LongTestEvery:  2,
+	TimeBetTests:   5,
+	RandTimeTest:   5,
+	IdleDurations:  []float64{30, 300, 900, 3600},
+}
+
+func TestParseYAML(t *testing.T) {
+	suites, err := Parse([]byte(`
+suites:
+  - name: mesh
+    wait_time: 5
+    rand_secs: 1
+    labels:
+      team: network
+  - name: large
+    protocol: http
+    discovery: static
+    dst_hst: "a:8081,b:8081"
+    long_test_bytes: 1000000
+    long_test_every: 1
+    wait_time: 60
+    test_timeout: 10
+`), defaults)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(suites))
+
+	assert.Equal(t, "mesh", suites[0].Name)
+	assert.Equal(t, "tcp", suites[0].Protocol)
+	assert.Equal(t, 1.0, suites[0].RandTimeTest)
+	assert.Equal(t, 10000, suites[0].LongTestBytes)
+	assert.Equal(t, map[string]string{"team": "network"}, suites[0].Labels)
+
+	assert.Equal(t, "large", suites[1].Name)
+	assert.Equal(t, "http", suites[1].Protocol)
+	assert.Equal(t, "a:8081,b:8081", suites[1].DestHost)
+	assert.Equal(t, 1000000, suites[1].LongTestBytes)
+	assert.Equal(t, 60.0, suites[1].TimeBetTests)
+	assert.Equal(t, 5.0, suites[1].RandTimeTest)
+	assert.Equal(t, 10.0, suites[1].TestTimeout)
+	assert.Nil(t, suites[1].Labels)
+}
+
+func TestParseJSON(t *testing.T) {
+	suites, err := Parse([]byte(`{"suites": [{"name": "mesh", "protocol": "udp", "udp_packets": 20}]}`), defaults)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(suites))
+	assert.Equal(t, "udp", suites[0].Protocol)
+	assert.Equal(t, 20, suites[0].UDPPackets)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`suites: []`, "Invalid config: no suites"},
+		{`suite: []`, "field suite not found"},
+		{"suites:\n  - name: mesh\n    wait_time: soon", "line 3: cannot unmarshal !!str `soon` into float64"},
+		{`suites: [{name: mesh, wait: 5}]`, "Invalid config: yaml: unmarshal errors:\n  line 1: field wait not found in type config.Suite"},
+		{`suites: [{protocol: tcp}]`, `Invalid suite 1: name "" must be made of letters, digits, _ and -`},
+		{`suites: [{name: mesh}, {name: mesh}]`, "Invalid suite mesh: name is used by another suite"},
+		{`suites: [{name: mesh, protocol: sctp}]`, `Invalid suite mesh: protocol "sctp" must be one of tcp, tcp_persistent, tcp_idle, http, grpc, udp, pmtu`},
+		{`suites: [{name: mesh, tcp_mode: both}]`, `Invalid suite mesh: tcp_mode "both" must be one of ack, echo, server_sends`},
+		{`suites: [{name: idle, protocol: tcp_idle, idle_durations: []}]`, "Invalid suite idle: idle_durations must be set to use tcp_idle"},
+		{`suites: [{name: idle, protocol: tcp_idle, idle_durations: [30, 0]}]`, "Invalid suite idle: idle_durations must all be more than 0, not 0"},
+		{`suites: [{name: idle, protocol: tcp_idle, idle_durations: [30, 300], test_timeout: 60}]`, "Invalid suite idle: test_timeout must be longer than every idle_durations, not 60"},
+		{`suites: [{name: mesh, discovery: file}]`, "Invalid suite mesh: discovery_file must be set to use file discovery"},
+		{`suites: [{name: mesh, discovery: static, dst_hst: ""}]`, "Invalid suite mesh: dst_hst must be set to use static discovery"},
+		{`suites: [{name: mesh, short_test_bytes: 0}]`, "Invalid suite mesh: short_test_bytes must be more than 0, not 0"},
+		{`suites: [{name: mesh, read_timeout: -1}]`, "Invalid suite mesh: read_timeout can't be negative"},
+		{`suites: [{name: loss, protocol: udp, connect_timeout: 1}]`, "Invalid suite loss: connect_timeout doesn't apply to udp suites"},
+		{`suites: [{protocol: pmtu, read_timeout: 1}]`, "Invalid suite 1: read_timeout doesn't apply to pmtu suites"},
+		{`suites: [{name: mesh, labels: {team-name: network}}]`, `Invalid suite mesh: label "team-name" isn't a valid prometheus label name`},
+		{`suites: [{name: mesh, labels: {dst_ip: x}}]`, `Invalid suite mesh: label "dst_ip" is already set on every metric`},
+		{`suites: [{name: mesh, labels: {suite: x}}]`, `Invalid suite mesh: label "suite" is already set on every metric`},
+	}
+	for _, test := range tests {
+		_, err := Parse([]byte(test.config), defaults)
+		if assert.Error(t, err, test.config) {
+			assert.Contains(t, err.Error(), test.err, test.config)
+		}
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	assert.Nil(t, defaults.Validate())
+}
+
+func TestInfoGaugeVec(t *testing.T) {
+	vec := InfoGaugeVec([]Suite{
+		{Name: "mesh", Labels: map[string]string{"team": "network"}},
+		{Name: "large", Labels: map[string]string{"tier": "1"}},
+	})
+	_, err := vec.GetMetricWithLabelValues("mesh", "network", "")
+	assert.Nil(t, err)
+	_, err = vec.GetMetricWithLabelValues("large", "", "1")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// Values of the status label of ReloadsCounterVec
+const (
+	ReloadSuccess = "success"
+	ReloadFailure = "failure"
+)
+
+// Set up the state of the config file as metrics
+var (
+	// Always 1, labelled with the hash of the config file that is running
+	HashGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_config_hash_info",
+		},
+		[]string{"hash"},
+	)
+
+	// 1 if the last reload was applied and 0 if it was rejected
+	LastReloadSuccessGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "conntest_config_last_reload_success_gauge",
+		},
+	)
+
+	LastReloadTimestampGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "conntest_config_last_reload_timestamp_seconds_gauge",
+		},
+	)
+
+	ReloadsCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conntest_config_reloads_total",
+		},
+		[]string{"status"},
+	)
+)
+
+// Hash identifies the contents of a config file
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Watcher loads a config file again whenever it changes, such as when the ConfigMap it is mounted from is edited
+type Watcher struct {
+	Path string
+	// Anything a suite leaves out is taken from Defaults
+	Defaults Suite
+	// How often to check whether the file has changed
+	Interval time.Duration
+	// Apply is given the suites every time the file is loaded, if it fails the suites already running are kept
+	Apply func([]Suite) error
+	// Hash of the file last loaded, whether or not it was applied
+	hash string
+}
+
+// Load loads the file and applies it, even if it hasn't changed
+func (w *Watcher) Load() error {
+	return w.reload(true)
+}
+
+// Run reloads the file every Interval if it has changed and every time reload receives a signal whether or not it
+// has, until ctx is done. A file that failed to load isn't tried again until it changes or reload is signalled
+func (w *Watcher) Run(ctx context.Context, reload <-chan os.Signal) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-reload:
+			log.Info("Received ", sig, ", reloading ", w.Path)
+			force = true
+		case <-ticker.C:
+		}
+		if err := w.reload(force); err != nil {
+			log.Error("Keeping the running suites: ", err)
+		}
+	}
+}
+
+// reload loads and applies the file if it has changed since it was last loaded or force is set
+func (w *Watcher) reload(force bool) error {
+	data, err := ioutil.ReadFile(w.Path)
+	if err != nil {
+		recordReload(ReloadFailure)
+		return err
+	}
+	hash := Hash(data)
+	if hash == w.hash && !force {
+		return nil
+	}
+	w.hash = hash
+	suites, err := Parse(data, w.Defaults)
+	if err == nil {
+		err = w.Apply(suites)
+	}
+	if err != nil {
+		recordReload(ReloadFailure)
+		return err
+	}
+	HashGaugeVec.Reset()
+	HashGaugeVec.WithLabelValues(hash).Set(1)
+	recordReload(ReloadSuccess)
+	log.Infof("Loaded %v suites from %v, hash %v", len(suites), w.Path, hash)
+	return nil
+}
+
+// recordReload exports the outcome of a reload
+func recordReload(status string) {
+	ReloadsCounterVec.WithLabelValues(status).Inc()
+	if status == ReloadSuccess {
+		LastReloadSuccessGauge.Set(1)
+	} else {
+		LastReloadSuccessGauge.Set(0)
+	}
+	LastReloadTimestampGauge.SetToCurrentTime()
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestWatcher checks that the file is applied again when it changes or on SIGHUP, and that bad files are rejected
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conntest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conntest.yaml")
+	write := func(config string) {
+		assert.Nil(t, ioutil.WriteFile(path, []byte(config), 0644))
+	}
+
+	applied := make(chan []Suite, 10)
+	w := &Watcher{
+		Path:     path,
+		Defaults: defaults,
+		Interval: 10 * time.Millisecond,
+		Apply: func(suites []Suite) error {
+			applied <- suites
+			return nil
+		},
+	}
+	write(`suites: [{name: mesh}]`)
+	assert.Nil(t, w.Load())
+	assert.Equal(t, "mesh", (<-applied)[0].Name)
+	assert.Equal(t, 1.0, testutil.ToFloat64(HashGaugeVec.WithLabelValues(Hash([]byte(`suites: [{name: mesh}]`)))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan os.Signal)
+	go w.Run(ctx, reload)
+
+	write(`suites: [{name: large}]`)
+	select {
+	case suites := <-applied:
+		assert.Equal(t, "large", suites[0].Name)
+	case <-time.After(time.Second):
+		t.Fatal("Changed file wasn't reloaded")
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(LastReloadSuccessGauge))
+
+	// An unchanged file is only applied again when asked to
+	reload <- syscall.SIGHUP
+	select {
+	case suites := <-applied:
+		assert.Equal(t, "large", suites[0].Name)
+	case <-time.After(time.Second):
+		t.Fatal("File wasn't reloaded on SIGHUP")
+	}
+
+	failures := testutil.ToFloat64(ReloadsCounterVec.WithLabelValues(ReloadFailure))
+	write(`suites: [{name: large, protocol: sctp}]`)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if testutil.ToFloat64(ReloadsCounterVec.WithLabelValues(ReloadFailure)) > failures {
+			break
+		}
+	}
+	assert.Equal(t, failures+1, testutil.ToFloat64(ReloadsCounterVec.WithLabelValues(ReloadFailure)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(LastReloadSuccessGauge))
+	assert.Equal(t, 0, len(applied))
+	// The hash is still that of the suites running
+	assert.Equal(t, 1.0, testutil.ToFloat64(HashGaugeVec.WithLabelValues(Hash([]byte(`suites: [{name: large}]`)))))
+}
@@ -0,0 +1,122 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// Endpoint is a peer that tests are sent to
+type Endpoint struct {
+	// host:port to connect to
+	Address string
+	// Name of the node the peer runs on and its topology zone, empty when the discovery backend doesn't know them
+	NodeName string
+	Zone     string
+}
+
+// Discoverer finds the endpoints that tests should be sent to, it is called again before every round of tests.
+// Discover gives up once ctx is done
+type Discoverer interface {
+	Discover(ctx context.Context) ([]Endpoint, error)
+}
+
+// fromAddresses makes endpoints that are only known by address
+func fromAddresses(addresses []string) []Endpoint {
+	endpoints := make([]Endpoint, len(addresses))
+	for i, address := range addresses {
+		endpoints[i] = Endpoint{Address: address}
+	}
+	return endpoints
+}
+
+// StaticDiscoverer always returns the same endpoints
+type StaticDiscoverer struct {
+	Endpoints []string
+}
+
+// NewStaticDiscoverer parses a comma separated list of host:port endpoints
+func NewStaticDiscoverer(list string) *StaticDiscoverer {
+	d := &StaticDiscoverer{}
+	for _, endpoint := range strings.Split(list, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint != "" {
+			d.Endpoints = append(d.Endpoints, endpoint)
+		}
+	}
+	return d
+}
+
+// Discover returns the configured endpoints
+func (d *StaticDiscoverer) Discover(ctx context.Context) ([]Endpoint, error) {
+	return fromAddresses(d.Endpoints), nil
+}
+
+// DNSDiscoverer resolves every A and AAAA record of a host, e.g. a headless service, and uses each address with the same port
+type DNSDiscoverer struct {
+	Host string
+	Port string
+}
+
+// NewDNSDiscoverer splits a host:port into a DNSDiscoverer
+func NewDNSDiscoverer(hostPort string) (*DNSDiscoverer, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSDiscoverer{Host: host, Port: port}, nil
+}
+
+// Discover looks up the addresses of the host
+func (d *DNSDiscoverer) Discover(ctx context.Context) ([]Endpoint, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, d.Host)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]string, len(ips))
+	for i, ip := range ips {
+		endpoints[i] = net.JoinHostPort(ip.IP.String(), d.Port)
+	}
+	log.Debug("Discovered endpoints: ", endpoints)
+	return fromAddresses(endpoints), nil
+}
+
+// FileDiscoverer reads endpoints from a file with one host:port per line, blank lines and lines starting with # are ignored.
+// The file is read again on every call so it can be changed while running
+type FileDiscoverer struct {
+	Path string
+}
+
+// Discover reads the endpoints from the file
+func (d *FileDiscoverer) Discover(ctx context.Context) ([]Endpoint, error) {
+	f, err := os.Open(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var endpoints []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		endpoint := strings.TrimSpace(scanner.Text())
+		if endpoint == "" || strings.HasPrefix(endpoint, "#") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", d.Path, line, err)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Debug("Discovered endpoints: ", endpoints)
+	return fromAddresses(endpoints), nil
+}
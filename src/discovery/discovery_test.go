@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStaticDiscoverer checks that a comma separated list is split and trimmed
+func TestStaticDiscoverer(t *testing.T) {
+	d := NewStaticDiscoverer("a:1, b:2,,c:3 ")
+	endpoints, err := d.Discover(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Endpoint{{Address: "a:1"}, {Address: "b:2"}, {Address: "c:3"}}, endpoints)
+}
+
+// TestDNSDiscoverer resolves localhost and checks the port is kept
+func TestDNSDiscoverer(t *testing.T) {
+	d, err := NewDNSDiscoverer("localhost:8080")
+	assert.Nil(t, err)
+	endpoints, err := d.Discover(context.Background())
+	assert.Nil(t, err)
+	assert.NotEmpty(t, endpoints)
+	for _, endpoint := range endpoints {
+		assert.Regexp(t, ":8080$", endpoint.Address)
+	}
+
+	_, err = NewDNSDiscoverer("localhost")
+	assert.NotNil(t, err)
+}
+
+// TestFileDiscoverer reads endpoints from a file, skipping comments, and rejects malformed lines
+func TestFileDiscoverer(t *testing.T) {
+	f, err := ioutil.TempFile("", "endpoints")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("# VMs\n10.0.0.1:8080\n\n  10.0.0.2:8080  \n")
+	f.Close()
+
+	d := &FileDiscoverer{Path: f.Name()}
+	endpoints, err := d.Discover(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Endpoint{{Address: "10.0.0.1:8080"}, {Address: "10.0.0.2:8080"}}, endpoints)
+
+	ioutil.WriteFile(f.Name(), []byte("10.0.0.1\n"), 0644)
+	_, err = d.Discover(context.Background())
+	assert.NotNil(t, err)
+
+	d = &FileDiscoverer{Path: "/does/not/exist"}
+	_, err = d.Discover(context.Background())
+	assert.NotNil(t, err)
+}
+
+// TestDiscoverEndpointsCancelled checks that a lookup cut short by ctx returns straight away without counting as failed
+func TestDiscoverEndpointsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failed := testutil.ToFloat64(TotalFailedSRVCounter)
+	_, err := DiscoverEndpoints(ctx, "conntest", "tcp", "conntest.invalid", 60, -1, 0)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, failed, testutil.ToFloat64(TotalFailedSRVCounter))
+}
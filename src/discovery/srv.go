@@ -0,0 +1,75 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Counts number of failed SRV discoveries
+var (
+	TotalFailedSRVCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "conntest_failed_SRV_discoveries_counter",
+		},
+	)
+)
+
+// SRVDiscoverer finds endpoints through the _service._protocol.name SRV record
+type SRVDiscoverer struct {
+	Service           string
+	Protocol          string
+	Name              string
+	RetryIntervalSecs float64
+	// Use -1 to retry indefinitely
+	MaxRetries int
+}
+
+// Discover looks up the SRV record, retrying as configured
+func (d *SRVDiscoverer) Discover(ctx context.Context) ([]Endpoint, error) {
+	endpoints, err := DiscoverEndpoints(ctx, d.Service, d.Protocol, d.Name, d.RetryIntervalSecs, d.MaxRetries, 0)
+	return fromAddresses(endpoints), err
+}
+
+// DiscoverEndpoints uses SRV records to discover available endpoints, retrying until ctx is done
+func DiscoverEndpoints(ctx context.Context, service, protocol, name string, retryIntervalSecs float64, maxRetries int, failed int) ([]string, error) {
+	var err error
+	_, srv, serr := net.DefaultResolver.LookupSRV(ctx, service, protocol, name)
+	for serr != nil {
+		if err := ctx.Err(); err != nil {
+			// The lookup failed because we gave up on it, not because there is no record
+			return make([]string, 0), err
+		}
+		failed++
+		log.Debug("Failed SRV discovery attempts: ", failed)
+		TotalFailedSRVCounter.Add(1)
+		// Use maxRetries = -1 to retry indefinitely
+		if maxRetries == -1 {
+		} else if failed > maxRetries {
+			err = fmt.Errorf("Attempt to discover SRV record timed out after %v retries", (failed - 1))
+			return make([]string, 0), err
+		}
+		err = fmt.Errorf("Cannot find SRV record, retrying in %v seconds...(attempt %v)", retryIntervalSecs, failed)
+		log.Error(err)
+		// Only understands nanoseconds
+		ti := int64(1e9 * retryIntervalSecs)
+		log.Debug("Time between retries: ", float64(ti)/float64(1e9), " seconds")
+		select {
+		case <-ctx.Done():
+			return make([]string, 0), ctx.Err()
+		case <-time.After(time.Duration(ti)):
+		}
+		_, srv, serr = net.DefaultResolver.LookupSRV(ctx, service, protocol, name)
+	}
+	endpoints := make([]string, len(srv))
+	for i := 0; i < len(srv); i++ {
+		log.Debug("Available endpoints: ", srv[i].Target, ":", srv[i].Port)
+		endpoints[i] = srv[i].Target + ":" + strconv.Itoa(int(srv[i].Port))
+	}
+	log.Debug("Discovered endpoints: ", endpoints)
+	return endpoints, serr
+}
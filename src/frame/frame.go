@@ -0,0 +1,208 @@
+package frame
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+// Every frame starts with a fixed header:
+// type (1 byte) | flags (1 byte) | payload length (4 bytes, big endian)
+// followed by the payload
+const HeaderSize = 6
+
+// MaxPayload is the largest payload a frame may carry. Readers of untrusted streams should lower Reader.MaxPayload,
+// as the whole payload is allocated as soon as its header has been read
+const MaxPayload = 1 << 28
+
+// Type says what a frame is for
+type Type byte
+
+// Frame types
+const (
+	// TypeData carries test data, which the receiver answers with TypeAck
+	TypeData Type = 1
+	// TypeAck acknowledges a frame
+	TypeAck Type = 2
+	// TypeEOS ends the test, the receiver acknowledges it and closes the connection
+	TypeEOS Type = 3
+	// TypeEcho carries test data, which the receiver sends straight back in a TypeEcho of its own
+	TypeEcho Type = 4
+	// TypeRequest asks the receiver to send a TypeData of as many bytes as its 4 byte, big endian payload says
+	TypeRequest Type = 5
+	// TypePing checks that a connection kept open between tests still works, the receiver answers with TypeAck
+	TypePing Type = 6
+	// TypeError refuses the frame it answers, its payload says why
+	TypeError Type = 7
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeData:
+		return "DATA"
+	case TypeAck:
+		return "ACK"
+	case TypeEOS:
+		return "EOS"
+	case TypeEcho:
+		return "ECHO"
+	case TypeRequest:
+		return "REQUEST"
+	case TypePing:
+		return "PING"
+	case TypeError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("Type(%d)", byte(t))
+}
+
+// Frame flags
+const (
+	// FlagChecksum marks payloads ending in a ChecksumSize trailer holding the Checksum of the rest of the payload.
+	// ACKs of such frames carry the Checksum the receiver computed of the data instead
+	FlagChecksum byte = 1 << 0
+)
+
+// ChecksumSize is the length of the trailer of frames with FlagChecksum
+const ChecksumSize = 4
+
+// castagnoli is the CRC32C table, which has hardware support on amd64 and arm64
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrTooLarge is returned for frames longer than MaxPayload, or than the Reader.MaxPayload of the Reader
+	ErrTooLarge = errors.New("Frame too large")
+	// ErrTruncated is returned when the input ends part way through a frame
+	ErrTruncated = errors.New("Truncated frame")
+	// ErrNoChecksum is returned when asking for the checksum of a frame that doesn't have one
+	ErrNoChecksum = errors.New("Frame has no checksum")
+)
+
+// Frame is one message of the protocol
+type Frame struct {
+	Type  Type
+	Flags byte
+	// Payload can hold any bytes, it is never interpreted by the codec
+	Payload []byte
+}
+
+// Checksum is the CRC32C of data
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// WithChecksum returns a frame of type t carrying data followed by its checksum. data is only copied if it doesn't
+// have room for the trailer, so leave ChecksumSize spare capacity to avoid that with large payloads
+func WithChecksum(t Type, data []byte) Frame {
+	trailer := make([]byte, ChecksumSize)
+	binary.BigEndian.PutUint32(trailer, Checksum(data))
+	return Frame{Type: t, Flags: FlagChecksum, Payload: append(data, trailer...)}
+}
+
+// SplitChecksum returns the data of f, a frame with FlagChecksum, and the checksum it was sent with. It doesn't check
+// them against each other, so that callers can report both when they don't match
+func (f Frame) SplitChecksum() ([]byte, uint32, error) {
+	if f.Flags&FlagChecksum == 0 {
+		return nil, 0, ErrNoChecksum
+	}
+	if len(f.Payload) < ChecksumSize {
+		return nil, 0, ErrTruncated
+	}
+	n := len(f.Payload) - ChecksumSize
+	return f.Payload[:n], binary.BigEndian.Uint32(f.Payload[n:]), nil
+}
+
+// header encodes the header of f
+func (f Frame) header() []byte {
+	h := make([]byte, HeaderSize)
+	h[0] = byte(f.Type)
+	h[1] = f.Flags
+	binary.BigEndian.PutUint32(h[2:6], uint32(len(f.Payload)))
+	return h
+}
+
+// Marshal encodes f
+func (f Frame) Marshal() ([]byte, error) {
+	if len(f.Payload) > MaxPayload {
+		return nil, ErrTooLarge
+	}
+	return append(f.header(), f.Payload...), nil
+}
+
+// Unmarshal decodes the frame at the start of buf and returns how many bytes of buf it took up.
+// The payload shares memory with buf
+func Unmarshal(buf []byte) (Frame, int, error) {
+	if len(buf) < HeaderSize {
+		return Frame{}, 0, ErrTruncated
+	}
+	length := binary.BigEndian.Uint32(buf[2:6])
+	if length > MaxPayload {
+		return Frame{}, 0, fmt.Errorf("%w: %v bytes", ErrTooLarge, length)
+	}
+	end := HeaderSize + int(length)
+	if len(buf) < end {
+		return Frame{}, 0, ErrTruncated
+	}
+	return Frame{Type: Type(buf[0]), Flags: buf[1], Payload: buf[HeaderSize:end]}, end, nil
+}
+
+// Write writes f to w, large payloads aren't copied into a buffer of their own first
+func Write(w io.Writer, f Frame) error {
+	if len(f.Payload) > MaxPayload {
+		return ErrTooLarge
+	}
+	// Sent in a single writev on sockets
+	buffers := net.Buffers{f.header(), f.Payload}
+	_, err := buffers.WriteTo(w)
+	return err
+}
+
+// Reader decodes frames from a stream
+type Reader struct {
+	r *bufio.Reader
+	// MaxPayload is the largest payload Read accepts, frames claiming to be longer are rejected before anything is
+	// allocated for them. It starts as the package's MaxPayload, and can't be raised above it
+	MaxPayload int
+}
+
+// NewReader returns a Reader reading frames from r. Pass the bufio.Reader that has been reading r so far, if any,
+// so that nothing it has buffered is lost
+func NewReader(r io.Reader) *Reader {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &Reader{r: br, MaxPayload: MaxPayload}
+	}
+	return &Reader{r: bufio.NewReader(r), MaxPayload: MaxPayload}
+}
+
+// Wait blocks until the next frame starts arriving, so that the time it takes to arrive can be measured
+func (r *Reader) Wait() error {
+	_, err := r.r.Peek(1)
+	return err
+}
+
+// Read reads the next frame, returning io.EOF only if the stream ends cleanly between frames
+func (r *Reader) Read() (Frame, error) {
+	h := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r.r, h); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Frame{}, ErrTruncated
+		}
+		return Frame{}, err
+	}
+	length := binary.BigEndian.Uint32(h[2:6])
+	if length > MaxPayload || int64(length) > int64(r.MaxPayload) {
+		return Frame{}, fmt.Errorf("%w: %v bytes", ErrTooLarge, length)
+	}
+	f := Frame{Type: Type(h[0]), Flags: h[1], Payload: make([]byte, length)}
+	if _, err := io.ReadFull(r.r, f.Payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return Frame{}, ErrTruncated
+		}
+		return Frame{}, err
+	}
+	return f, nil
+}
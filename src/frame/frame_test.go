@@ -0,0 +1,99 @@
+package frame
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRoundTrip checks that frames survive a stream unchanged, including payloads with newlines and zero bytes
+func TestRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Type: TypeData, Payload: []byte("line one\nline two\n")},
+		{Type: TypeData, Flags: 0xff, Payload: []byte{0, 1, 2, 0, '\n', 0xff}},
+		{Type: TypeAck},
+		{Type: TypeEOS},
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		assert.Nil(t, Write(&buf, f))
+	}
+	r := NewReader(&buf)
+	for _, f := range frames {
+		g, err := r.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, f.Type, g.Type)
+		assert.Equal(t, f.Flags, g.Flags)
+		assert.Equal(t, len(f.Payload), len(g.Payload))
+		assert.True(t, bytes.Equal(f.Payload, g.Payload))
+	}
+	_, err := r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+// TestSharedReader checks that a Reader made from a bufio.Reader carries on where it left off
+func TestSharedReader(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("HELLO version=2\n")
+	assert.Nil(t, Write(&buf, Frame{Type: TypeData, Payload: []byte("abc")}))
+	br := bufio.NewReader(&buf)
+	line, err := br.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "HELLO version=2\n", line)
+	f, err := NewReader(br).Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(f.Payload))
+}
+
+// TestBadFrames checks that truncated and oversized frames are rejected rather than decoded
+func TestBadFrames(t *testing.T) {
+	_, err := NewReader(strings.NewReader("\x01\x00\x00\x00")).Read()
+	assert.Equal(t, ErrTruncated, err)
+	_, err = NewReader(strings.NewReader("\x01\x00\x00\x00\x00\x05abc")).Read()
+	assert.Equal(t, ErrTruncated, err)
+	_, err = NewReader(strings.NewReader("\x01\x00\xff\xff\xff\xff")).Read()
+	assert.True(t, errors.Is(err, ErrTooLarge))
+	limited := NewReader(strings.NewReader("\x01\x00\x00\x00\x00\x05abcde"))
+	limited.MaxPayload = 4
+	_, err = limited.Read()
+	assert.True(t, errors.Is(err, ErrTooLarge))
+	_, _, err = Unmarshal([]byte("\x01\x00\x00\x00\x00\x05abc"))
+	assert.Equal(t, ErrTruncated, err)
+	assert.Equal(t, ErrTooLarge, Write(&bytes.Buffer{}, Frame{Type: TypeData, Payload: make([]byte, MaxPayload+1)}))
+}
+
+// TestChecksum checks that the checksum trailer survives a round trip and reveals a flipped bit
+func TestChecksum(t *testing.T) {
+	data := make([]byte, 100, 100+ChecksumSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	f := WithChecksum(TypeData, data)
+	assert.Equal(t, FlagChecksum, f.Flags)
+	// The spare capacity was used rather than copying
+	assert.Equal(t, &data[0], &f.Payload[0])
+
+	var buf bytes.Buffer
+	assert.Nil(t, Write(&buf, f))
+	g, err := NewReader(&buf).Read()
+	assert.Nil(t, err)
+	got, sum, err := g.SplitChecksum()
+	assert.Nil(t, err)
+	assert.Equal(t, Checksum(data), sum)
+	assert.Equal(t, Checksum(got), sum)
+
+	got[42] ^= 0x10
+	assert.NotEqual(t, Checksum(got), sum)
+
+	_, _, err = Frame{Type: TypeData, Payload: data}.SplitChecksum()
+	assert.Equal(t, ErrNoChecksum, err)
+	_, _, err = Frame{Type: TypeData, Flags: FlagChecksum, Payload: []byte{1}}.SplitChecksum()
+	assert.Equal(t, ErrTruncated, err)
+	// Known answer from RFC 3720
+	assert.Equal(t, uint32(0xe3069283), Checksum([]byte("123456789")))
+}
@@ -0,0 +1,72 @@
+package frame
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fuzz decodes data as a stream of frames both with Unmarshal and with a Reader, panicking if they disagree or if a
+// frame doesn't encode back to the bytes it was decoded from. It returns 1 if data held at least one frame
+func fuzz(data []byte) int {
+	r := NewReader(bytes.NewReader(data))
+	rest := data
+	frames := 0
+	for {
+		f, n, err := Unmarshal(rest)
+		g, readErr := r.Read()
+		if err != nil {
+			if readErr == nil {
+				panic(fmt.Sprintf("Reader decoded %v that Unmarshal rejected: %v", g.Type, err))
+			}
+			if len(rest) == 0 && readErr != io.EOF {
+				panic(fmt.Sprintf("Reader didn't end cleanly between frames: %v", readErr))
+			}
+			break
+		}
+		if readErr != nil {
+			panic(fmt.Sprintf("Unmarshal decoded %v that Reader rejected: %v", f.Type, readErr))
+		}
+		if f.Type != g.Type || f.Flags != g.Flags || !bytes.Equal(f.Payload, g.Payload) {
+			panic("Unmarshal and Reader decoded different frames")
+		}
+		b, err := f.Marshal()
+		if err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(b, rest[:n]) {
+			panic("Frame doesn't encode back to the bytes it was decoded from")
+		}
+		rest = rest[n:]
+		frames++
+	}
+	if frames == 0 {
+		return 0
+	}
+	return 1
+}
+
+// TestFuzz runs the fuzz checks over every input in testdata/corpus, which has a file for each shape of stream the
+// codec has to cope with. Those named valid-* hold at least one frame
+func TestFuzz(t *testing.T) {
+	dir := filepath.Join("testdata", "corpus")
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		assert.Nil(t, err)
+		want := 0
+		if strings.HasPrefix(file.Name(), "valid-") {
+			want = 1
+		}
+		assert.Equal(t, want, fuzz(data), file.Name())
+	}
+}
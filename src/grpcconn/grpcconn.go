@@ -0,0 +1,248 @@
+package grpcconn
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn"
+)
+
+var log = logrus.New()
+
+// Names used on the wire, the messages are plain BytesValues so no generated code is needed
+const (
+	ServiceName      = "conntest.Probe"
+	echoMethod       = "Echo"
+	streamEchoMethod = "StreamEcho"
+)
+
+// Set up simple server side metrics to be exported
+var (
+	// Total number of RPCs handled by the server, streams count once per message
+	RPCsHandledTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "conntest_grpc_rpcs_handled_total",
+		},
+	)
+)
+
+// Set up per RPC metrics
+var (
+	RPCLatencyHistVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "conntest_grpc_rpc_latency_seconds_hist",
+			Buckets: peer.LatencyBuckets,
+		},
+		peer.Labels(
+			// Echo or StreamEcho, for streams each message round trip is observed, failed ones included
+			"method",
+		),
+	)
+
+	RPCStatusCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conntest_grpc_rpc_status_counter",
+		},
+		peer.Labels(
+			"method",
+			// gRPC status code the RPC finished with
+			"code",
+		),
+	)
+)
+
+// ProbeServer answers Echo and StreamEcho RPCs by sending back what it received
+type ProbeServer interface {
+	Echo(context.Context, *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error)
+	StreamEcho(grpc.ServerStream) error
+}
+
+type probeServer struct{}
+
+// Echo returns the request unchanged
+func (probeServer) Echo(ctx context.Context, in *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error) {
+	RPCsHandledTotal.Inc()
+	return in, nil
+}
+
+// StreamEcho returns every message received on the stream until the client closes it
+func (probeServer) StreamEcho(stream grpc.ServerStream) error {
+	for {
+		in := new(wrapperspb.BytesValue)
+		err := stream.RecvMsg(in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		RPCsHandledTotal.Inc()
+		err = stream.SendMsg(in)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func echoHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrapperspb.BytesValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProbeServer).Echo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + ServiceName + "/" + echoMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProbeServer).Echo(ctx, req.(*wrapperspb.BytesValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func streamEchoHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ProbeServer).StreamEcho(stream)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*ProbeServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: echoMethod,
+			Handler:    echoHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    streamEchoMethod,
+			Handler:       streamEchoHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+// DealWithGRPCConnections serves the probe service on s until the listener is closed
+func DealWithGRPCConnections(s net.Listener) error {
+	srv := grpc.NewServer()
+	srv.RegisterService(&serviceDesc, probeServer{})
+	err := srv.Serve(s)
+	log.Debug("Error serving gRPC connections: ", err)
+	return err
+}
+
+// SendGRPCRequests runs one unary Echo and one StreamEcho of msgCount messages against p.Dst within
+// tcpconn.ClientTimeouts
+func SendGRPCRequests(ctx context.Context, p peer.Peer, msgBytes int, msgCount int) error {
+	_, err := SendGRPCRequestsWithin(ctx, p, msgBytes, msgCount, tcpconn.ClientTimeouts)
+	return err
+}
+
+// SendGRPCRequestsWithin runs one unary Echo and one StreamEcho of msgCount messages, each carrying msgBytes bytes,
+// against p.Dst, giving up as soon as ctx is done. timeouts.Connect bounds connecting, and each RPC can take no longer
+// than timeouts.RoundTrip for every message it carries. It returns p with the source address filled in once connected
+func SendGRPCRequestsWithin(ctx context.Context, p peer.Peer, msgBytes int, msgCount int, timeouts tcpconn.Timeouts) (peer.Peer, error) {
+	// Dial ourselves so that the source address of the connection can be used as a label
+	var localAddr atomic.Value
+	localAddr.Store("")
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		c, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err == nil {
+			localAddr.Store(c.LocalAddr().(*net.TCPAddr).IP.String())
+		}
+		return c, err
+	}
+	// Connect before the first RPC, so that connecting is held to its own timeout. Refused connections fail straight
+	// away rather than being retried until the timeout
+	dialCtx, cancel := within(ctx, timeouts.Connect)
+	conn, err := grpc.DialContext(dialCtx, p.Dst, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dialer), grpc.WithBlock(), grpc.FailOnNonTempDialError(true), grpc.WithReturnConnectionError())
+	cancel()
+	if err != nil {
+		return p, err
+	}
+	defer conn.Close()
+	defer log.Debug("Client finished sending to ", p.Dst)
+	p.Src = localAddr.Load().(string)
+
+	msg := &wrapperspb.BytesValue{Value: make([]byte, msgBytes)}
+	observe := func(method string, start time.Time) {
+		RPCLatencyHistVec.WithLabelValues(p.Values(method)...).Observe(time.Since(start).Seconds())
+	}
+	finish := func(method string, err error) error {
+		RPCStatusCounterVec.WithLabelValues(p.Values(method, status.Code(err).String())...).Inc()
+		return err
+	}
+
+	rpcCtx, cancel := within(ctx, timeouts.RoundTrip())
+	start := time.Now()
+	err = conn.Invoke(rpcCtx, "/"+ServiceName+"/"+echoMethod, msg, new(wrapperspb.BytesValue))
+	cancel()
+	observe(echoMethod, start)
+	if err = finish(echoMethod, err); err != nil {
+		return p, err
+	}
+
+	rpcCtx, cancel = within(ctx, time.Duration(msgCount)*timeouts.RoundTrip())
+	defer cancel()
+	err = streamEcho(rpcCtx, conn, msg, msgCount, func(start time.Time) { observe(streamEchoMethod, start) })
+	return p, finish(streamEchoMethod, err)
+}
+
+// streamEcho sends msg msgCount times on a new StreamEcho, calling observe with when each one was sent once its echo
+// arrives or doesn't, and returns the status the stream finished with
+func streamEcho(ctx context.Context, conn *grpc.ClientConn, msg *wrapperspb.BytesValue, msgCount int, observe func(start time.Time)) error {
+	start := time.Now()
+	stream, err := conn.NewStream(ctx, &serviceDesc.Streams[0], "/"+ServiceName+"/"+streamEchoMethod)
+	if err != nil {
+		observe(start)
+		return err
+	}
+	for i := 0; i < msgCount; i++ {
+		start = time.Now()
+		err = stream.SendMsg(msg)
+		if err == nil || err == io.EOF {
+			// SendMsg only says that the stream has ended, receiving gives the status it ended with
+			err = stream.RecvMsg(new(wrapperspb.BytesValue))
+		}
+		observe(start)
+		if err != nil {
+			return err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	// The stream only finishes, with the status the server ended it with, once everything it sent has been read
+	for {
+		err = stream.RecvMsg(new(wrapperspb.BytesValue))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// within returns a copy of ctx that is also done once d has passed, unless d is zero
+func within(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
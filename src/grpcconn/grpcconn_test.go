@@ -0,0 +1,135 @@
+package grpcconn
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn"
+)
+
+// TestOnceSmallMessages runs one unary and one short stream with small messages
+func TestOnceSmallMessages(t *testing.T) {
+	addr := "127.0.0.1:9979"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go DealWithGRPCConnections(s)
+	err = SendGRPCRequests(context.Background(), peer.Peer{Dst: addr, NodeName: "TestOnceSmallMessages"}, 10, 5)
+	assert.Nil(t, err)
+}
+
+// TestMultiLargeMessagesConc runs several clients concurrently with large streamed messages
+func TestMultiLargeMessagesConc(t *testing.T) {
+	addr := "127.0.0.1:9978"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	numConnections := 5
+	go DealWithGRPCConnections(s)
+
+	ch := make(chan error)
+	defer close(ch)
+	for i := 0; i < numConnections; i++ {
+		go func() {
+			ch <- SendGRPCRequests(context.Background(), peer.Peer{Dst: addr, NodeName: "TestMultiLargeMessagesConc"}, 1000000, 20)
+		}()
+	}
+	for i := 0; i < numConnections; i++ {
+		assert.Nil(t, <-ch)
+	}
+}
+
+// failingServer echoes streams like the real one, but ends them with an error once the client has finished sending
+type failingServer struct {
+	probeServer
+}
+
+func (failingServer) StreamEcho(stream grpc.ServerStream) error {
+	for {
+		in := new(wrapperspb.BytesValue)
+		if err := stream.RecvMsg(in); err == io.EOF {
+			return status.Error(codes.Internal, "failed after the last message")
+		} else if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(in); err != nil {
+			return err
+		}
+	}
+}
+
+// TestStreamStatus checks that a stream the server ends with an error fails the test
+func TestStreamStatus(t *testing.T) {
+	addr := "127.0.0.1:9967"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	srv := grpc.NewServer()
+	srv.RegisterService(&serviceDesc, failingServer{})
+	go srv.Serve(s)
+	defer srv.Stop()
+
+	p, err := SendGRPCRequestsWithin(context.Background(), peer.Peer{Dst: addr, NodeName: "TestStreamStatus"}, 10, 5, tcpconn.ClientTimeouts)
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	// The stream counts once, with the status it finished with rather than one OK for every message
+	assert.Equal(t, 1.0, testutil.ToFloat64(RPCStatusCounterVec.WithLabelValues(p.Values(echoMethod, "OK")...)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(RPCStatusCounterVec.WithLabelValues(p.Values(streamEchoMethod, "OK")...)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(RPCStatusCounterVec.WithLabelValues(p.Values(streamEchoMethod, "Internal")...)))
+}
+
+// slowServer takes a second to answer an Echo
+type slowServer struct {
+	probeServer
+}
+
+func (slowServer) Echo(ctx context.Context, in *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error) {
+	time.Sleep(time.Second)
+	return in, nil
+}
+
+// TestRPCTimeout checks that an RPC the server is slow to answer gives up after the read timeout
+func TestRPCTimeout(t *testing.T) {
+	addr := "127.0.0.1:9962"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	srv := grpc.NewServer()
+	srv.RegisterService(&serviceDesc, slowServer{})
+	go srv.Serve(s)
+	defer srv.Stop()
+
+	timeouts := tcpconn.Timeouts{Connect: time.Second, Read: 100 * time.Millisecond, Write: 100 * time.Millisecond}
+	start := time.Now()
+	p, err := SendGRPCRequestsWithin(context.Background(), peer.Peer{Dst: addr, NodeName: "TestRPCTimeout"}, 10, 5, timeouts)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Failed RPCs are timed as well
+	var metric dto.Metric
+	RPCLatencyHistVec.WithLabelValues(p.Values(echoMethod)...).(prometheus.Metric).Write(&metric)
+	assert.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+	assert.Equal(t, 1.0, testutil.ToFloat64(RPCStatusCounterVec.WithLabelValues(p.Values(echoMethod, "DeadlineExceeded")...)))
+}
@@ -0,0 +1,202 @@
+package httpconn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn"
+)
+
+var log = logrus.New()
+
+// TestPath is the path the server handles test requests on
+const TestPath = "/conntest"
+
+// ErrUnexpectedStatus is returned when the target answers a test with anything but 200 OK
+var ErrUnexpectedStatus = errors.New("Unexpected response")
+
+// Set up simple server side metrics to be exported
+var (
+	// Total number of HTTP requests handled by the server
+	RequestsHandledTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "conntest_http_requests_handled_total",
+		},
+	)
+)
+
+// Set up request timings as metrics, all in seconds
+var (
+	DNSGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_http_dns_seconds_gauge",
+		},
+		peer.Labels(),
+	)
+
+	ConnectGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_http_connect_seconds_gauge",
+		},
+		peer.Labels(),
+	)
+
+	TLSGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_http_tls_handshake_seconds_gauge",
+		},
+		peer.Labels(),
+	)
+
+	FirstByteGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_http_time_to_first_byte_seconds_gauge",
+		},
+		peer.Labels(),
+	)
+
+	TotalGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_http_total_seconds_gauge",
+		},
+		peer.Labels(),
+	)
+
+	TotalHistVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "conntest_http_total_seconds_hist",
+			Buckets: peer.TransferBuckets,
+		},
+		peer.Labels(),
+	)
+
+	ResponseCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conntest_http_responses_counter",
+		},
+		peer.Labels(
+			// HTTP status code returned by the target
+			"code",
+		),
+	)
+)
+
+// HandleHTTPRequest reads the whole body of a test request and acknowledges it
+func HandleHTTPRequest(w http.ResponseWriter, r *http.Request) {
+	log.Debug("Serving ", r.RemoteAddr)
+	defer log.Debug("Finished serving ", r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := io.Copy(ioutil.Discard, r.Body)
+	if err != nil {
+		log.Debug(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Debug("Server received ", n, " bytes from ", r.RemoteAddr)
+	RequestsHandledTotal.Inc()
+	w.Write([]byte("ACK\n"))
+}
+
+// DealWithHTTPConnections serves test requests on s until the listener is closed
+func DealWithHTTPConnections(s net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(TestPath, HandleHTTPRequest)
+	err := http.Serve(s, mux)
+	log.Debug("Error serving HTTP connections: ", err)
+	return err
+}
+
+// SendHTTPRequest sends a request carrying bytesToSend bytes of body to p.Dst within tcpconn.ClientTimeouts
+func SendHTTPRequest(ctx context.Context, p peer.Peer, bytesToSend int) error {
+	_, err := SendHTTPRequestWithin(ctx, p, bytesToSend, tcpconn.ClientTimeouts)
+	return err
+}
+
+// SendHTTPRequestWithin sends a request carrying bytesToSend bytes of body to p.Dst and records how long each stage
+// took, giving up as soon as ctx is done. p.Dst is a host:port, optionally prefixed with https:// to test over TLS.
+// timeouts.Connect bounds connecting and the TLS handshake, timeouts.Read waiting for the response once the request is
+// sent, and the whole request can take no longer than timeouts.Total. It returns p with the source address filled in
+// once connected
+func SendHTTPRequestWithin(ctx context.Context, p peer.Peer, bytesToSend int, timeouts tcpconn.Timeouts) (peer.Peer, error) {
+	url := p.Dst
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	url += TestPath
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(strings.Repeat("a", bytesToSend)))
+	if err != nil {
+		return p, err
+	}
+
+	var dnsStart, dnsDone, connectStart, connectDone, tlsStart, tlsDone, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { dnsDone = time.Now() },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(string, string, error) { connectDone = time.Now() },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.LocalAddr().(*net.TCPAddr); ok {
+				p.Src = addr.IP.String()
+			}
+		},
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	// A fresh connection per test so that connection setup is measured every time
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: timeouts.Connect}).DialContext,
+			TLSHandshakeTimeout:   timeouts.Connect,
+			ResponseHeaderTimeout: timeouts.Read,
+			DisableKeepAlives:     true,
+		},
+		Timeout: timeouts.Total(),
+	}
+	defer log.Debug("Client finished sending to ", p.Dst)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return p, err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return p, err
+	}
+	total := time.Since(start)
+	log.Debug("Local IP: ", p.Src)
+
+	DNSGaugeVec.WithLabelValues(p.Values()...).Set(dnsDone.Sub(dnsStart).Seconds())
+	ConnectGaugeVec.WithLabelValues(p.Values()...).Set(connectDone.Sub(connectStart).Seconds())
+	TLSGaugeVec.WithLabelValues(p.Values()...).Set(tlsDone.Sub(tlsStart).Seconds())
+	FirstByteGaugeVec.WithLabelValues(p.Values()...).Set(firstByte.Sub(start).Seconds())
+	TotalGaugeVec.WithLabelValues(p.Values()...).Set(total.Seconds())
+	TotalHistVec.WithLabelValues(p.Values()...).Observe(total.Seconds())
+	ResponseCounterVec.WithLabelValues(p.Values(fmt.Sprint(resp.StatusCode))...).Inc()
+
+	if resp.StatusCode != http.StatusOK {
+		return p, fmt.Errorf("%w from %v: %v", ErrUnexpectedStatus, p.Dst, resp.Status)
+	}
+	return p, nil
+}
@@ -0,0 +1,80 @@
+package httpconn
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn"
+)
+
+// TestOnceSmallRequest sends one small request to the server
+func TestOnceSmallRequest(t *testing.T) {
+	addr := "0.0.0.0:9989"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go DealWithHTTPConnections(s)
+	err = SendHTTPRequest(context.Background(), peer.Peer{Dst: addr, NodeName: "TestOnceSmallRequest"}, 10)
+	assert.Nil(t, err)
+}
+
+// TestMultiLargeRequestsSeq sends many large requests one at a time
+func TestMultiLargeRequestsSeq(t *testing.T) {
+	addr := "0.0.0.0:9988"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go DealWithHTTPConnections(s)
+	for i := 0; i < 20; i++ {
+		err = SendHTTPRequest(context.Background(), peer.Peer{Dst: addr, NodeName: "TestMultiLargeRequestsSeq"}, 1000000)
+		assert.Nil(t, err)
+	}
+}
+
+// TestWrongMethod checks that the server rejects anything other than a POST
+func TestWrongMethod(t *testing.T) {
+	addr := "0.0.0.0:9987"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go DealWithHTTPConnections(s)
+	resp, err := http.Get("http://" + addr + TestPath)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+// TestInvalidRequest uses an invalid address and checks that errors are returned as expected
+func TestInvalidRequest(t *testing.T) {
+	err := SendHTTPRequest(context.Background(), peer.Peer{Dst: "some_string", NodeName: "TestInvalidRequest"}, 10)
+	assert.NotNil(t, err)
+}
+
+// TestReadTimeout checks that a request to a peer that never answers gives up after the read timeout
+func TestReadTimeout(t *testing.T) {
+	addr := "127.0.0.1:9963"
+	// Connections are accepted by the kernel but nothing ever reads from them
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	timeouts := tcpconn.Timeouts{Connect: time.Second, Read: 100 * time.Millisecond, Write: 100 * time.Millisecond}
+	start := time.Now()
+	_, err = SendHTTPRequestWithin(context.Background(), peer.Peer{Dst: addr, NodeName: "TestReadTimeout"}, 10, timeouts)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,188 @@
+package kubediscovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/thought-machine/conntest/src/discovery"
+)
+
+var log = logrus.New()
+
+// SyncTimeout is how long Start waits for the first list of EndpointSlices, so that a suite whose API server can't be
+// reached fails to start instead of holding up the others
+var SyncTimeout = time.Minute
+
+// Watcher keeps a live set of endpoints of a Service by watching its EndpointSlices
+type Watcher struct {
+	// Name of the port in the Service to send tests to, empty uses the first port
+	portName string
+	factory  informers.SharedInformerFactory
+	synced   cache.InformerSynced
+	lister   discoverylisters.EndpointSliceLister
+}
+
+// NewWatcher watches the EndpointSlices of service in namespace, using port portName of each endpoint
+func NewWatcher(client kubernetes.Interface, namespace string, service string, portName string, resync time.Duration) *Watcher {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, resync,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = discoveryv1.LabelServiceName + "=" + service
+		}),
+	)
+	informer := factory.Discovery().V1().EndpointSlices()
+	return &Watcher{
+		portName: portName,
+		factory:  factory,
+		synced:   informer.Informer().HasSynced,
+		lister:   informer.Lister(),
+	}
+}
+
+// inClusterClient connects using the service account of the pod it's running in
+func inClusterClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// NewInClusterWatcher creates a Watcher using the service account of the pod it's running in
+func NewInClusterWatcher(namespace string, service string, portName string) (*Watcher, error) {
+	client, err := inClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return NewWatcher(client, namespace, service, portName, 10*time.Minute), nil
+}
+
+// zoneLabels are the node labels holding its zone, newest first
+var zoneLabels = []string{
+	"topology.kubernetes.io/zone",
+	"failure-domain.beta.kubernetes.io/zone",
+}
+
+// NodeZone looks up the zone of node nodeName from its topology labels
+func NodeZone(client kubernetes.Interface, nodeName string) (string, error) {
+	node, err := client.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, label := range zoneLabels {
+		if zone, ok := node.Labels[label]; ok {
+			return zone, nil
+		}
+	}
+	return "", fmt.Errorf("Node %v has no zone label", nodeName)
+}
+
+// InClusterNodeZone looks up the zone of node nodeName using the service account of the pod it's running in
+func InClusterNodeZone(nodeName string) (string, error) {
+	client, err := inClusterClient()
+	if err != nil {
+		return "", err
+	}
+	return NodeZone(client, nodeName)
+}
+
+// Start begins watching until stopCh is closed, and waits up to SyncTimeout for the first list of EndpointSlices
+func (w *Watcher) Start(stopCh <-chan struct{}) error {
+	return w.StartWithin(stopCh, SyncTimeout)
+}
+
+// StartWithin begins watching until stopCh is closed, and waits up to timeout for the first list of EndpointSlices.
+// A timeout of zero waits for as long as it takes
+func (w *Watcher) StartWithin(stopCh <-chan struct{}, timeout time.Duration) error {
+	w.factory.Start(stopCh)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	// Waiting gives up on whichever comes first, without stopping the watch itself
+	giveUp := make(chan struct{})
+	synced := make(chan struct{})
+	defer close(synced)
+	go func() {
+		defer close(giveUp)
+		select {
+		case <-stopCh:
+		case <-expired:
+		case <-synced:
+		}
+	}()
+	if !cache.WaitForCacheSync(giveUp, w.synced) {
+		return errors.New("Timed out waiting for EndpointSlices to sync")
+	}
+	return nil
+}
+
+// Discover returns the ready endpoints currently known, along with the node and zone each one runs in.
+// They are already in memory, so ctx is never waited on
+func (w *Watcher) Discover(ctx context.Context) ([]discovery.Endpoint, error) {
+	slices, err := w.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var endpoints []discovery.Endpoint
+	for _, slice := range slices {
+		port, ok := w.port(slice)
+		if !ok {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			// Endpoints without a ready condition are to be treated as ready
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, address := range ep.Addresses {
+				endpoint := discovery.Endpoint{Address: net.JoinHostPort(address, port)}
+				if seen[endpoint.Address] {
+					continue
+				}
+				seen[endpoint.Address] = true
+				if ep.NodeName != nil {
+					endpoint.NodeName = *ep.NodeName
+				}
+				if ep.Zone != nil {
+					endpoint.Zone = *ep.Zone
+				}
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Address < endpoints[j].Address })
+	log.Debug("Discovered endpoints: ", endpoints)
+	return endpoints, nil
+}
+
+// port finds the number of the port to test in slice
+func (w *Watcher) port(slice *discoveryv1.EndpointSlice) (string, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if w.portName == "" || (p.Name != nil && *p.Name == w.portName) {
+			return strconv.Itoa(int(*p.Port)), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,137 @@
+package kubediscovery
+
+import (
+	"context"
+	"time"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/thought-machine/conntest/src/discovery"
+)
+
+func strPtr(s string) *string { return &s }
+
+func boolPtr(b bool) *bool { return &b }
+
+func int32Ptr(i int32) *int32 { return &i }
+
+// endpointSlice makes a slice of service with tcp and http ports
+func endpointSlice(name string, service string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: strPtr("tcp"), Port: int32Ptr(8080)},
+			{Name: strPtr("http"), Port: int32Ptr(8081)},
+		},
+	}
+}
+
+// TestWatcher checks that the watcher follows EndpointSlices being added, changed and removed
+func TestWatcher(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(
+		endpointSlice("conntest-a", "conntest",
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}, NodeName: strPtr("node-1"), Zone: strPtr("zone-a")},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.2"}, NodeName: strPtr("node-2"), Conditions: discoveryv1.EndpointConditions{Ready: boolPtr(false)}},
+		),
+		endpointSlice("other", "other",
+			discoveryv1.Endpoint{Addresses: []string{"10.0.1.1"}},
+		),
+	)
+
+	w := NewWatcher(client, "default", "conntest", "http", 0)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.Nil(t, w.Start(stopCh))
+
+	endpoints, err := w.Discover(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []discovery.Endpoint{{Address: "10.0.0.1:8081", NodeName: "node-1", Zone: "zone-a"}}, endpoints)
+
+	_, err = client.DiscoveryV1().EndpointSlices("default").Create(ctx, endpointSlice("conntest-b", "conntest",
+		discoveryv1.Endpoint{Addresses: []string{"10.0.0.3"}, NodeName: strPtr("node-3"), Zone: strPtr("zone-b")},
+	), metav1.CreateOptions{})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		endpoints, _ := w.Discover(context.Background())
+		return len(endpoints) == 2 && endpoints[1].NodeName == "node-3"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = client.DiscoveryV1().EndpointSlices("default").Delete(ctx, "conntest-a", metav1.DeleteOptions{})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		endpoints, _ := w.Discover(context.Background())
+		return len(endpoints) == 1 && endpoints[0].Address == "10.0.0.3:8081"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// TestWatcherMissingPort checks that slices without the named port are skipped
+func TestWatcherMissingPort(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		endpointSlice("conntest-a", "conntest", discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}}),
+	)
+
+	w := NewWatcher(client, "default", "conntest", "grpc", 0)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.Nil(t, w.Start(stopCh))
+
+	endpoints, err := w.Discover(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, endpoints)
+}
+
+// TestWatcherSyncTimeout checks that Start gives up on an API server that never lists the EndpointSlices
+func TestWatcherSyncTimeout(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	client.PrependReactor("list", "endpointslices", func(k8stesting.Action) (bool, runtime.Object, error) {
+		<-unblock
+		return false, nil, nil
+	})
+
+	w := NewWatcher(client, "default", "conntest", "http", 0)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	start := time.Now()
+	assert.NotNil(t, w.StartWithin(stopCh, 100*time.Millisecond))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+// TestNodeZone checks the zone is read from current and deprecated node labels
+func TestNodeZone(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "new", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "old", Labels: map[string]string{"failure-domain.beta.kubernetes.io/zone": "zone-b"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "none"}},
+	)
+
+	zone, err := NodeZone(client, "new")
+	assert.Nil(t, err)
+	assert.Equal(t, "zone-a", zone)
+
+	zone, err = NodeZone(client, "old")
+	assert.Nil(t, err)
+	assert.Equal(t, "zone-b", zone)
+
+	_, err = NodeZone(client, "none")
+	assert.NotNil(t, err)
+
+	_, err = NodeZone(client, "missing")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,54 @@
+package peer
+
+import (
+	"github.com/thought-machine/conntest/src/discovery"
+)
+
+// LabelNames are the labels carried by every per peer metric, in the order of Peer.Values
+var LabelNames = []string{
+	// Host and port of the target we are sending tests to
+	"dst_ip",
+	// IP address of the source the tests are being sent from
+	"src_ip",
+	// Name of current node
+	"node_name",
+	// Name of the node the target runs on
+	"dst_node",
+	// Topology zones of the current node and of the target's node
+	"src_zone",
+	"dst_zone",
+	// Whether the test sent a short or a long payload
+	"test_size",
+	// Name of the suite the test belongs to
+	"suite",
+}
+
+// Labels returns LabelNames followed by any labels specific to one metric
+func Labels(extra ...string) []string {
+	return append(append([]string{}, LabelNames...), extra...)
+}
+
+// Peer identifies both ends of a test
+type Peer struct {
+	Dst      string
+	Src      string
+	NodeName string
+	DstNode  string
+	SrcZone  string
+	DstZone  string
+	TestSize string
+	Suite    string
+}
+
+// Values returns the values of LabelNames for p followed by extra
+func (p Peer) Values(extra ...string) []string {
+	return append([]string{p.Dst, p.Src, p.NodeName, p.DstNode, p.SrcZone, p.DstZone, p.TestSize, p.Suite}, extra...)
+}
+
+// To returns a copy of p, which describes the local end, aimed at endpoint
+func (p Peer) To(endpoint discovery.Endpoint) Peer {
+	p.Dst = endpoint.Address
+	p.DstNode = endpoint.NodeName
+	p.DstZone = endpoint.Zone
+	return p
+}
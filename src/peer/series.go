@@ -0,0 +1,150 @@
+package peer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Buckets of the histograms of durations, in seconds
+var (
+	// LatencyBuckets go from 100µs to about 50s, for round trips and connecting
+	LatencyBuckets = prometheus.ExponentialBuckets(1e-4, 2, 20)
+	// TransferBuckets go from 1ms to about 9 minutes, for moving whole payloads and connections that live as long as
+	// a test does
+	TransferBuckets = prometheus.ExponentialBuckets(1e-3, 2, 20)
+)
+
+// Vec is a per peer metric that series can be deleted from, all of the prometheus *Vec types are
+type Vec interface {
+	prometheus.Collector
+	Delete(labels prometheus.Labels) bool
+}
+
+var (
+	vecsMutex sync.Mutex
+	vecs      []Vec
+)
+
+// MustRegister registers per peer metrics with Prometheus, and remembers them so that Forget can clean them up
+func MustRegister(vs ...Vec) {
+	vecsMutex.Lock()
+	defer vecsMutex.Unlock()
+	for _, v := range vs {
+		prometheus.MustRegister(v)
+		vecs = append(vecs, v)
+	}
+}
+
+// Forget deletes every series with all of the labels in match from the metrics registered with MustRegister, so that
+// targets that have gone don't linger with their last values. It returns how many series were deleted
+func Forget(match prometheus.Labels) int {
+	vecsMutex.Lock()
+	defer vecsMutex.Unlock()
+	return forget(vecs, match)
+}
+
+// Server side metrics are about the clients testing us rather than the peers we test, so they are cleaned up by
+// when each client was last seen instead of by discovery
+var (
+	clientsMutex sync.Mutex
+	clientVecs   []Vec
+	// When each client, by the IP it connects from, last connected
+	clientsSeen = make(map[string]time.Time)
+)
+
+// MustRegisterClients registers server side metrics with Prometheus, which must be labelled with the src_ip clients
+// connect from, and remembers them so that ForgetStaleClients can clean them up
+func MustRegisterClients(vs ...Vec) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	for _, v := range vs {
+		prometheus.MustRegister(v)
+		clientVecs = append(clientVecs, v)
+	}
+}
+
+// SeenClient notes that a client has just connected from ip
+func SeenClient(ip string) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	clientsSeen[ip] = time.Now()
+}
+
+// ForgetStaleClients deletes the series of clients that haven't connected for ttl from the metrics registered with
+// MustRegisterClients, checking every interval until ctx is done
+func ForgetStaleClients(ctx context.Context, ttl time.Duration, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		forgetStaleClients(ttl)
+	}
+}
+
+// forgetStaleClients deletes the series of clients that haven't connected for ttl, returning how many were deleted
+func forgetStaleClients(ttl time.Duration) int {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	deleted := 0
+	for ip, seen := range clientsSeen {
+		if time.Since(seen) < ttl {
+			continue
+		}
+		deleted += forget(clientVecs, prometheus.Labels{"src_ip": ip})
+		delete(clientsSeen, ip)
+	}
+	return deleted
+}
+
+// forget deletes every series with all of the labels in match from vs, returning how many were deleted
+func forget(vs []Vec, match prometheus.Labels) int {
+	deleted := 0
+	for _, v := range vs {
+		for _, labels := range seriesOf(v, match) {
+			if v.Delete(labels) {
+				deleted++
+			}
+		}
+	}
+	return deleted
+}
+
+// seriesOf finds the labels of every series of v with all of the labels in match
+func seriesOf(v Vec, match prometheus.Labels) []prometheus.Labels {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		v.Collect(ch)
+		close(ch)
+	}()
+	var series []prometheus.Labels
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			continue
+		}
+		labels := make(prometheus.Labels, len(metric.Label))
+		for _, pair := range metric.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if matches(labels, match) {
+			series = append(series, labels)
+		}
+	}
+	return series
+}
+
+// matches reports whether labels has all of the labels in match
+func matches(labels prometheus.Labels, match prometheus.Labels) bool {
+	for name, value := range match {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
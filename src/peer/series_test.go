@@ -0,0 +1,55 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestForget checks that only the series of the forgotten target in the forgotten suite are deleted
+func TestForget(t *testing.T) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "conntest_test_forget_gauge"}, Labels())
+	hist := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "conntest_test_forget_hist"}, Labels("method"))
+	MustRegister(gauge, hist)
+
+	gone := Peer{Dst: "10.0.0.1:8080", NodeName: "node-a", Suite: "mesh"}
+	kept := Peer{Dst: "10.0.0.2:8080", NodeName: "node-a", Suite: "mesh"}
+	otherSuite := Peer{Dst: "10.0.0.1:8080", NodeName: "node-a", Suite: "large"}
+	gauge.WithLabelValues(gone.Values()...).Set(1)
+	gauge.WithLabelValues(gone.Values()...).Set(1)
+	gone.TestSize = "long"
+	gauge.WithLabelValues(gone.Values()...).Set(1)
+	hist.WithLabelValues(gone.Values("Echo")...).Observe(1)
+	gauge.WithLabelValues(kept.Values()...).Set(1)
+	hist.WithLabelValues(kept.Values("Echo")...).Observe(1)
+	gauge.WithLabelValues(otherSuite.Values()...).Set(1)
+
+	match := prometheus.Labels{"dst_ip": gone.Dst, "suite": gone.Suite}
+	assert.Equal(t, 3, Forget(match))
+	assert.Empty(t, seriesOf(gauge, match))
+	assert.Empty(t, seriesOf(hist, match))
+	assert.Len(t, seriesOf(gauge, prometheus.Labels{"dst_ip": kept.Dst}), 1)
+	assert.Len(t, seriesOf(hist, prometheus.Labels{"dst_ip": kept.Dst}), 1)
+	assert.Len(t, seriesOf(gauge, prometheus.Labels{"dst_ip": otherSuite.Dst, "suite": otherSuite.Suite}), 1)
+	assert.Equal(t, 0, Forget(match))
+}
+
+// TestForgetStaleClients checks that only the series of clients that haven't connected for the TTL are deleted
+func TestForgetStaleClients(t *testing.T) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "conntest_test_forget_clients_gauge"}, []string{"src_node", "src_ip"})
+	MustRegisterClients(gauge)
+
+	SeenClient("10.0.0.1")
+	gauge.WithLabelValues("node-a", "10.0.0.1").Set(1)
+	gauge.WithLabelValues("node-b", "10.0.0.1").Set(1)
+	time.Sleep(50 * time.Millisecond)
+	SeenClient("10.0.0.2")
+	gauge.WithLabelValues("node-c", "10.0.0.2").Set(1)
+
+	assert.Equal(t, 2, forgetStaleClients(25*time.Millisecond))
+	assert.Empty(t, seriesOf(gauge, prometheus.Labels{"src_ip": "10.0.0.1"}))
+	assert.Len(t, seriesOf(gauge, prometheus.Labels{"src_ip": "10.0.0.2"}), 1)
+	assert.Equal(t, 0, forgetStaleClients(25*time.Millisecond))
+}
@@ -0,0 +1,207 @@
+package pmtu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/udpconn"
+)
+
+var log = logrus.New()
+
+// Sizes are UDP payload sizes, the path MTU is the payload plus IP and UDP headers
+const (
+	ipv4Overhead = 20 + 8
+	ipv6Overhead = 40 + 8
+	// Every IPv4 host must accept 576 byte datagrams, IPv6 guarantees 1280
+	minIPv4MTU = 576
+	minIPv6MTU = 1280
+	// Largest payload a single UDP datagram can carry
+	maxPayload = 65507
+)
+
+// Each size is attempted a few times so that ordinary packet loss isn't taken for a black hole
+const (
+	probeAttempts = 3
+	probeTimeout  = 500 * time.Millisecond
+)
+
+// Set up path MTU discovery results as metrics
+var (
+	DiscoveredPmtuGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_pmtu_discovered_bytes_gauge",
+		},
+		peer.Labels(),
+	)
+
+	InterfaceMtuGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_pmtu_interface_mtu_bytes_gauge",
+		},
+		peer.Labels(),
+	)
+
+	// 1 when the path can't carry packets as large as the local interface sends, 0 otherwise
+	MismatchGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_pmtu_mismatch_gauge",
+		},
+		peer.Labels(),
+	)
+)
+
+// search binary searches for the largest size in [lo, hi] for which fits is true, assuming lo fits
+func search(lo int, hi int, fits func(int) (bool, error)) (int, error) {
+	// Most paths are fine, so check the top first to save a whole search
+	ok, err := fits(hi)
+	if err != nil || ok {
+		return hi, err
+	}
+	hi--
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		ok, err := fits(mid)
+		if err != nil {
+			return lo, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
+
+// interfaceMTU finds the MTU of the local interface that has ip assigned
+func interfaceMTU(ip net.IP) (int, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return iface.MTU, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("No interface found with address %v", ip)
+}
+
+// probe sends a datagram of size bytes with Don't Fragment set and reports whether the responder answered it
+func probe(c *net.UDPConn, size int, seq uint32) (bool, error) {
+	buf := make([]byte, size)
+	reply := make([]byte, udpconn.HeaderSize)
+	for attempt := 0; attempt < probeAttempts; attempt++ {
+		udpconn.Header{Type: udpconn.TypePMTU, Seq: seq, SentTime: time.Now()}.Marshal(buf)
+		_, err := c.Write(buf)
+		if isMsgSize(err) {
+			// The kernel already knows this can't leave the host without fragmenting
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		deadline := time.Now().Add(probeTimeout)
+		c.SetReadDeadline(deadline)
+		for time.Now().Before(deadline) {
+			n, err := c.Read(reply)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				// ICMP errors are also reported here, try again until we run out of attempts
+				log.Debug("Error receiving PMTU probe reply: ", err)
+				continue
+			}
+			h, err := udpconn.ParseHeader(reply[:n])
+			if err == nil && h.Type == udpconn.TypePMTU && h.Seq == seq {
+				return true, nil
+			}
+		}
+		seq++
+	}
+	return false, nil
+}
+
+// DiscoverPMTU finds the largest datagram that reaches the UDP responder at p.Dst without being fragmented
+// and compares it with the MTU of the interface it leaves through, giving up as soon as ctx is done. It returns p with
+// the source address filled in
+func DiscoverPMTU(ctx context.Context, p peer.Peer) (peer.Peer, error) {
+	addr, err := net.ResolveUDPAddr("udp", p.Dst)
+	if err != nil {
+		return p, err
+	}
+	c, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return p, err
+	}
+	defer c.Close()
+	defer log.Debug("Client finished PMTU discovery to ", p.Dst)
+	localIP := c.LocalAddr().(*net.UDPAddr).IP
+	p.Src = localIP.String()
+
+	err = setProbeMode(c, localIP.To4() == nil)
+	if err != nil {
+		return p, errors.New("Error while attempting to set Don't Fragment: " + err.Error())
+	}
+
+	overhead, minMTU := ipv4Overhead, minIPv4MTU
+	if localIP.To4() == nil {
+		overhead, minMTU = ipv6Overhead, minIPv6MTU
+	}
+	ifaceMTU, err := interfaceMTU(localIP)
+	if err != nil {
+		return p, err
+	}
+	hi := ifaceMTU - overhead
+	if hi > maxPayload {
+		hi = maxPayload
+	}
+	lo := minMTU - overhead
+
+	var seq uint32
+	fits := func(size int) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		seq += probeAttempts
+		ok, err := probe(c, size, seq)
+		log.Debug("PMTU probe of ", size, " bytes to ", p.Dst, " got through: ", ok)
+		return ok, err
+	}
+	ok, err := fits(udpconn.HeaderSize)
+	if err != nil {
+		return p, err
+	}
+	if !ok {
+		return p, fmt.Errorf("No reply from UDP responder at %v", p.Dst)
+	}
+	found, err := search(lo, hi, fits)
+	if err != nil {
+		return p, err
+	}
+
+	mismatch := 0.0
+	if found < hi {
+		mismatch = 1
+		log.Infof("Path MTU to %v is %v, lower than the %v MTU of the local interface", p.Dst, found+overhead, ifaceMTU)
+	}
+	DiscoveredPmtuGaugeVec.WithLabelValues(p.Values()...).Set(float64(found + overhead))
+	InterfaceMtuGaugeVec.WithLabelValues(p.Values()...).Set(float64(ifaceMTU))
+	MismatchGaugeVec.WithLabelValues(p.Values()...).Set(mismatch)
+	return p, nil
+}
@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package pmtu
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// setProbeMode sets Don't Fragment on c while ignoring the kernel's cached path MTU, so oversized datagrams are
+// sent as they are and either arrive or get dropped along the path
+func setProbeMode(c *net.UDPConn, ipv6 bool) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// isMsgSize reports whether err means the datagram is larger than the local interface allows
+func isMsgSize(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.EMSGSIZE
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package pmtu
+
+import (
+	"errors"
+	"net"
+)
+
+// setProbeMode is only implemented for Linux
+func setProbeMode(c *net.UDPConn, ipv6 bool) error {
+	return errors.New("PMTU probing is only supported on Linux")
+}
+
+// isMsgSize is never true as probing can't be set up
+func isMsgSize(err error) bool {
+	return false
+}
@@ -0,0 +1,45 @@
+package pmtu
+
+import (
+	"context"
+	"net"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/udpconn"
+)
+
+// TestSearch checks the binary search against paths with various limits
+func TestSearch(t *testing.T) {
+	for _, limit := range []int{548, 549, 1000, 1422, 1472, 8972} {
+		fits := func(size int) (bool, error) {
+			return size <= limit, nil
+		}
+		found, err := search(548, 8972, fits)
+		assert.Nil(t, err)
+		assert.Equal(t, limit, found)
+	}
+}
+
+// TestDiscoverPMTULoopback discovers the path MTU to a local responder, which should match the loopback interface
+func TestDiscoverPMTULoopback(t *testing.T) {
+	addr := "127.0.0.1:9959"
+	s, err := net.ListenPacket("udp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go udpconn.DealWithUDPConnections(s)
+	p, err := DiscoverPMTU(context.Background(), peer.Peer{Dst: addr, NodeName: "TestDiscoverPMTULoopback"})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", p.Src)
+}
+
+// TestDiscoverPMTUNoResponder checks that an error is returned when nothing answers the probes
+func TestDiscoverPMTUNoResponder(t *testing.T) {
+	_, err := DiscoverPMTU(context.Background(), peer.Peer{Dst: "127.0.0.1:9958", NodeName: "TestDiscoverPMTUNoResponder"})
+	assert.NotNil(t, err)
+}
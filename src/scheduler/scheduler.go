@@ -0,0 +1,206 @@
+package scheduler
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/thought-machine/conntest/src/discovery"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/srvendpoints"
+	"github.com/thought-machine/conntest/src/testplan"
+)
+
+var log = logrus.New()
+
+// Set up the state of the scheduler as metrics
+var (
+	TargetsGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_scheduler_targets_gauge",
+		},
+		[]string{"suite"},
+	)
+
+	TestsInFlightGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "conntest_scheduler_tests_in_flight_gauge",
+		},
+	)
+)
+
+// Scheduler tests every discovered target in a loop of its own, so that a slow target only delays its own tests
+type Scheduler struct {
+	Discoverer discovery.Discoverer
+	// Describes this end of the tests
+	Local peer.Peer
+	Send  srvendpoints.SendFunc
+	// Release is called once no more tests will be sent to a target, to free anything Send keeps for it. Optional
+	Release func(p peer.Peer)
+	// Every target gets its own copy of Plan
+	Plan testplan.Plan
+	// Tests to send to each target, 0 sends forever
+	Cycles int
+	// Wait says how long to pause between two tests of a target, it should add jitter so that targets drift apart
+	Wait func() time.Duration
+	// How often to look for added and removed targets
+	DiscoveryInterval time.Duration
+	// Most tests to have in flight at once across all targets, 0 doesn't limit them
+	MaxConcurrent int
+	// How long after a target disappears to delete its series, in case it's only gone briefly
+	StaleSeriesTTL time.Duration
+	// Longest a single test may take, 0 doesn't limit it
+	TestTimeout time.Duration
+}
+
+// target is the loop testing one endpoint
+type target struct {
+	stop func()
+	done chan struct{}
+}
+
+// Run discovers targets every DiscoveryInterval, starting a loop for each new one and stopping the loops of those
+// that have gone. Once ctx is done no more tests are started and Run waits for those in flight to finish, testCtx
+// interrupts them. When Cycles is set Run also returns once every target has been sent all of them
+func (s *Scheduler) Run(ctx context.Context, testCtx context.Context) {
+	var sem chan struct{}
+	if s.MaxConcurrent > 0 {
+		sem = make(chan struct{}, s.MaxConcurrent)
+	}
+	var wg sync.WaitGroup
+	targets := make(map[string]*target)
+	// When each target that has disappeared was last seen
+	gone := make(map[string]time.Time)
+	defer func() {
+		// Loops stop by themselves once ctx is done, leaving the tests in flight to finish
+		wg.Wait()
+		TargetsGaugeVec.WithLabelValues(s.Local.Suite).Set(0)
+	}()
+
+	for {
+		endpoints, err := s.Discoverer.Discover(ctx)
+		if err != nil && ctx.Err() != nil {
+			// Stopping, which interrupted discovery
+			return
+		} else if err != nil {
+			// Carry on testing the targets we already know about
+			log.Error(err)
+		} else {
+			s.sync(ctx, testCtx, endpoints, targets, gone, sem, &wg)
+		}
+		s.forgetStale(gone)
+		if s.Cycles > 0 && len(targets) > 0 && allDone(targets) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.DiscoveryInterval):
+		}
+	}
+}
+
+// sync starts loops for endpoints that don't have one and stops the loops of targets no longer in endpoints,
+// noting when they went in gone
+func (s *Scheduler) sync(ctx context.Context, testCtx context.Context, endpoints []discovery.Endpoint, targets map[string]*target, gone map[string]time.Time, sem chan struct{}, wg *sync.WaitGroup) {
+	current := make(map[string]bool, len(endpoints))
+	for _, endpoint := range endpoints {
+		current[endpoint.Address] = true
+		delete(gone, endpoint.Address)
+		if _, ok := targets[endpoint.Address]; ok {
+			continue
+		}
+		log.Debug("Starting tests to ", endpoint.Address)
+		loopCtx, stopLoop := context.WithCancel(ctx)
+		targetCtx, stopTests := context.WithCancel(testCtx)
+		t := &target{
+			stop: func() {
+				stopLoop()
+				stopTests()
+			},
+			done: make(chan struct{}),
+		}
+		targets[endpoint.Address] = t
+		wg.Add(1)
+		go func(p peer.Peer) {
+			defer wg.Done()
+			defer close(t.done)
+			s.loop(loopCtx, targetCtx, p, sem)
+			if s.Release != nil {
+				s.Release(p)
+			}
+		}(s.Local.To(endpoint))
+	}
+	for address, t := range targets {
+		if !current[address] {
+			log.Debug("Stopping tests to ", address)
+			t.stop()
+			delete(targets, address)
+			gone[address] = time.Now()
+		}
+	}
+	TargetsGaugeVec.WithLabelValues(s.Local.Suite).Set(float64(len(targets)))
+}
+
+// forgetStale deletes the series of targets that have been gone for longer than StaleSeriesTTL
+func (s *Scheduler) forgetStale(gone map[string]time.Time) {
+	for address, since := range gone {
+		if time.Since(since) < s.StaleSeriesTTL {
+			continue
+		}
+		deleted := peer.Forget(prometheus.Labels{"dst_ip": address, "suite": s.Local.Suite})
+		log.Debug("Deleted ", deleted, " series of ", address, " after it disappeared")
+		delete(gone, address)
+	}
+}
+
+// loop sends the plan to p until ctx is done
+func (s *Scheduler) loop(ctx context.Context, testCtx context.Context, p peer.Peer, sem chan struct{}) {
+	// Start each target at a random point of the interval so that tests are spread out rather than sent in bursts
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Duration(rand.Int63n(int64(s.Wait()) + 1))):
+	}
+	plan := s.Plan
+	plan.Run(ctx, s.Cycles, func(test testplan.Test) error {
+		free := func() {}
+		if sem != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case sem <- struct{}{}:
+			}
+			var once sync.Once
+			free = func() { once.Do(func() { <-sem }) }
+			defer free()
+		}
+		TestsInFlightGauge.Inc()
+		defer TestsInFlightGauge.Dec()
+		p.TestSize = test.Size
+		ctx := srvendpoints.WithSlot(testCtx, free)
+		if s.TestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.TestTimeout)
+			defer cancel()
+		}
+		srvendpoints.Probe(ctx, s.Send, p, test.Bytes)
+		return nil
+	}, s.Wait)
+}
+
+// allDone reports whether every target has finished its loop
+func allDone(targets map[string]*target) bool {
+	for _, t := range targets {
+		select {
+		case <-t.done:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,315 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/conntest/src/discovery"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/srvendpoints"
+	"github.com/thought-machine/conntest/src/testplan"
+)
+
+// fakeDiscoverer returns whatever addresses it was last set to
+type fakeDiscoverer struct {
+	mu        sync.Mutex
+	addresses []string
+}
+
+func (d *fakeDiscoverer) set(addresses ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.addresses = addresses
+}
+
+func (d *fakeDiscoverer) Discover(ctx context.Context) ([]discovery.Endpoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	endpoints := make([]discovery.Endpoint, len(d.addresses))
+	for i, address := range d.addresses {
+		endpoints[i] = discovery.Endpoint{Address: address}
+	}
+	return endpoints, nil
+}
+
+// counter counts the tests sent to each target
+type counter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *counter) add(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[address]++
+}
+
+func (c *counter) get(address string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[address]
+}
+
+// eventually waits up to a second for cond to become true
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+// newScheduler makes a scheduler that tests often
+func newScheduler(d discovery.Discoverer, send srvendpoints.SendFunc) *Scheduler {
+	return &Scheduler{
+		Discoverer:        d,
+		Local:             peer.Peer{NodeName: "TestScheduler"},
+		Send:              send,
+		Plan:              testplan.Plan{ShortBytes: 10, LongBytes: 10000, LongEvery: 2},
+		Wait:              func() time.Duration { return time.Millisecond },
+		DiscoveryInterval: 10 * time.Millisecond,
+	}
+}
+
+// TestSlowTargetDoesNotDelayOthers checks that a target that never answers doesn't hold up tests to the others
+func TestSlowTargetDoesNotDelayOthers(t *testing.T) {
+	d := &fakeDiscoverer{}
+	d.set("fast:1", "slow:1")
+	c := &counter{counts: make(map[string]int)}
+	unblock := make(chan struct{})
+	s := newScheduler(d, func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		if p.Dst == "slow:1" {
+			<-unblock
+		}
+		c.add(p.Dst)
+		return p, nil
+	})
+	s.Cycles = 3
+
+	finished := make(chan struct{})
+	go func() {
+		s.Run(context.Background(), context.Background())
+		close(finished)
+	}()
+	assert.True(t, eventually(func() bool { return c.get("fast:1") == 3 }))
+	assert.Equal(t, 0, c.get("slow:1"))
+
+	close(unblock)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Scheduler didn't finish once every target was sent all its cycles")
+	}
+	assert.Equal(t, 3, c.get("slow:1"))
+}
+
+// TestMaxConcurrent checks that no more than MaxConcurrent tests are ever in flight
+func TestMaxConcurrent(t *testing.T) {
+	d := &fakeDiscoverer{}
+	d.set("a:1", "b:1", "c:1", "d:1")
+	var mu sync.Mutex
+	inFlight, maxInFlight, sent := 0, 0, 0
+	s := newScheduler(d, func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		mu.Lock()
+		inFlight++
+		sent++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(2 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return p, nil
+	})
+	s.Cycles = 3
+	s.MaxConcurrent = 2
+	s.Run(context.Background(), context.Background())
+	assert.Equal(t, 12, sent)
+	assert.True(t, maxInFlight <= 2)
+}
+
+// TestFreeSlot checks that a test that gives back its slot doesn't hold up the others while it carries on
+func TestFreeSlot(t *testing.T) {
+	d := &fakeDiscoverer{}
+	d.set("a:1", "b:1")
+	sent := &counter{counts: make(map[string]int)}
+	s := newScheduler(d, func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		sent.add(p.Dst)
+		if p.Dst == "a:1" {
+			srvendpoints.FreeSlot(ctx)
+			<-ctx.Done()
+		}
+		return p, nil
+	})
+	s.MaxConcurrent = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	testCtx, cancelTests := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Run(ctx, testCtx)
+		close(finished)
+	}()
+	assert.True(t, eventually(func() bool { return sent.get("a:1") == 1 && sent.get("b:1") > 1 }))
+	cancel()
+	cancelTests()
+	<-finished
+}
+
+// TestTargetsFollowDiscovery checks that loops are started for new targets and stopped for removed ones
+func TestTargetsFollowDiscovery(t *testing.T) {
+	d := &fakeDiscoverer{}
+	d.set("a:1")
+	c := &counter{counts: make(map[string]int)}
+	s := newScheduler(d, func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		c.add(p.Dst)
+		return p, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Run(ctx, context.Background())
+		close(finished)
+	}()
+	assert.True(t, eventually(func() bool { return c.get("a:1") > 0 }))
+
+	d.set("b:1")
+	assert.True(t, eventually(func() bool { return c.get("b:1") > 0 }))
+	// Give the removed target's loop time to notice, after which it mustn't send anything else
+	time.Sleep(50 * time.Millisecond)
+	stopped := c.get("a:1")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, stopped, c.get("a:1"))
+
+	cancel()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Scheduler didn't stop once its context was cancelled")
+	}
+}
+
+// TestDrain checks that tests in flight are left to finish when the scheduler is stopped
+func TestDrain(t *testing.T) {
+	d := &fakeDiscoverer{}
+	d.set("a:1")
+	started := make(chan struct{})
+	var once sync.Once
+	var finished error
+	s := newScheduler(d, func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		once.Do(func() { close(started) })
+		select {
+		case <-ctx.Done():
+			finished = ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+		return p, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	s.Run(ctx, context.Background())
+	assert.Nil(t, finished)
+}
+
+// countSeries counts the series c currently has
+func countSeries(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}
+
+// TestForgetStale checks that the series of a target are deleted once it has been gone for StaleSeriesTTL
+func TestForgetStale(t *testing.T) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "conntest_test_stale_gauge"}, peer.Labels())
+	peer.MustRegister(gauge)
+
+	d := &fakeDiscoverer{}
+	d.set("a:1", "b:1")
+	s := newScheduler(d, func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		gauge.WithLabelValues(p.Values()...).Set(1)
+		return p, nil
+	})
+	s.StaleSeriesTTL = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx, context.Background())
+	// Both sizes of test to both targets
+	assert.True(t, eventually(func() bool { return countSeries(gauge) == 4 }))
+
+	d.set("a:1")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 4, countSeries(gauge))
+	assert.True(t, eventually(func() bool { return countSeries(gauge) == 2 }))
+}
+
+// TestTestTimeout checks that a test taking longer than TestTimeout is cancelled
+func TestTestTimeout(t *testing.T) {
+	d := &fakeDiscoverer{}
+	d.set("a:1")
+	var finished error
+	s := newScheduler(d, func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		select {
+		case <-ctx.Done():
+			finished = ctx.Err()
+		case <-time.After(time.Second):
+		}
+		return p, nil
+	})
+	s.Cycles = 1
+	s.TestTimeout = 10 * time.Millisecond
+	s.Run(context.Background(), context.Background())
+	assert.Equal(t, context.DeadlineExceeded, finished)
+}
+
+// TestRelease checks that targets are released once they are removed, and the rest once the scheduler stops
+func TestRelease(t *testing.T) {
+	d := &fakeDiscoverer{}
+	d.set("a:1")
+	sent := &counter{counts: make(map[string]int)}
+	released := &counter{counts: make(map[string]int)}
+	s := newScheduler(d, func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		sent.add(p.Dst)
+		return p, nil
+	})
+	s.Release = func(p peer.Peer) {
+		released.add(p.Dst)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		s.Run(ctx, context.Background())
+		close(finished)
+	}()
+	assert.True(t, eventually(func() bool { return sent.get("a:1") > 0 }))
+	d.set("b:1")
+	assert.True(t, eventually(func() bool { return released.get("a:1") == 1 }))
+	assert.Equal(t, 0, released.get("b:1"))
+
+	cancel()
+	<-finished
+	assert.Equal(t, 1, released.get("a:1"))
+	assert.Equal(t, 1, released.get("b:1"))
+}
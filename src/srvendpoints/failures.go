@@ -0,0 +1,126 @@
+package srvendpoints
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thought-machine/conntest/src/httpconn"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn"
+	"github.com/thought-machine/conntest/src/udpconn"
+)
+
+// Reasons a probe can fail for, the values of the reason label
+const (
+	ReasonRefused       = "refused"
+	ReasonTimeout       = "timeout"
+	ReasonReset         = "reset"
+	ReasonDNS           = "dns"
+	ReasonEOF           = "eof"
+	ReasonProtocolError = "protocol_error"
+	ReasonShortRead     = "short_read"
+	ReasonCorrupt       = "corrupt"
+	ReasonOther         = "other"
+)
+
+// Set up probe outcomes as metrics, together they give the success ratio of each pair of peers
+var (
+	ProbeFailuresCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conntest_probe_failures_total",
+		},
+		peer.Labels(
+			// Why the probe failed, one of the Reason constants
+			"reason",
+		),
+	)
+
+	ProbeSuccessesCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conntest_probe_successes_total",
+		},
+		peer.Labels(),
+	)
+)
+
+// classify works out why a probe failed from the error it returned
+func classify(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return ReasonDNS
+	case errors.Is(err, tcpconn.ErrShortRead):
+		return ReasonShortRead
+	case errors.Is(err, tcpconn.ErrCorrupt):
+		return ReasonCorrupt
+	case errors.Is(err, tcpconn.ErrUnexpectedReply), errors.Is(err, httpconn.ErrUnexpectedStatus):
+		return ReasonProtocolError
+	case errors.Is(err, udpconn.ErrNoEchoes), errors.Is(err, context.DeadlineExceeded):
+		return ReasonTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return ReasonReset
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ReasonEOF
+	}
+	// gRPC doesn't wrap the errors underneath its status codes, what went wrong with the connection is only in the
+	// message
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.DeadlineExceeded:
+			return ReasonTimeout
+		case codes.Unavailable, codes.Unknown:
+			return classifyMessage(s.Message())
+		default:
+			return ReasonProtocolError
+		}
+	}
+	return ReasonOther
+}
+
+// connectionMessages are what the errors classify checks for say, in the order they are checked
+var connectionMessages = []struct {
+	text   string
+	reason string
+}{
+	{"no such host", ReasonDNS},
+	{"i/o timeout", ReasonTimeout},
+	{"connection refused", ReasonRefused},
+	{"connection reset", ReasonReset},
+	{"broken pipe", ReasonReset},
+	{"EOF", ReasonEOF},
+}
+
+// classifyMessage works out why a probe failed from the message of an error that doesn't wrap its cause
+func classifyMessage(message string) string {
+	for _, m := range connectionMessages {
+		if strings.Contains(message, m.text) {
+			return m.reason
+		}
+	}
+	return ReasonOther
+}
+
+// recordOutcome counts the result err of a probe to p, probes we cancelled ourselves are neither
+func recordOutcome(p peer.Peer, err error) {
+	if err == context.Canceled {
+		return
+	}
+	if err == nil {
+		ProbeSuccessesCounterVec.WithLabelValues(p.Values()...).Inc()
+		return
+	}
+	ProbeFailuresCounterVec.WithLabelValues(p.Values(classify(err))...).Inc()
+}
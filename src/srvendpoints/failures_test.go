@@ -0,0 +1,85 @@
+package srvendpoints
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thought-machine/conntest/src/grpcconn"
+	"github.com/thought-machine/conntest/src/httpconn"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn"
+	"github.com/thought-machine/conntest/src/udpconn"
+)
+
+// timeoutError is a net.Error that has timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestClassifyRefused dials a port nothing listens on
+func TestClassifyRefused(t *testing.T) {
+	_, err := net.Dial("tcp", "127.0.0.1:9985")
+	assert.NotNil(t, err)
+	assert.Equal(t, ReasonRefused, classify(err))
+}
+
+// TestClassifyGRPCRefused sends gRPC requests to a port nothing listens on
+func TestClassifyGRPCRefused(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := grpcconn.SendGRPCRequests(ctx, peer.Peer{Dst: "127.0.0.1:9985", NodeName: "TestClassifyGRPCRefused"}, 10, 1)
+	assert.NotNil(t, err)
+	assert.Equal(t, ReasonRefused, classify(err))
+}
+
+// TestClassify checks the reason given for the errors the probes return
+func TestClassify(t *testing.T) {
+	cases := map[error]string{
+		&net.DNSError{Err: "no such host", Name: "conntest"}:                     ReasonDNS,
+		&net.OpError{Op: "read", Err: timeoutError{}}:                            ReasonTimeout,
+		fmt.Errorf("%w from 10.0.0.1:8080", tcpconn.ErrShortRead):                ReasonShortRead,
+		fmt.Errorf("%w to 10.0.0.1:8080", tcpconn.ErrCorrupt):                    ReasonCorrupt,
+		fmt.Errorf("%w from 10.0.0.1:8080: \"NAK\"", tcpconn.ErrUnexpectedReply): ReasonProtocolError,
+		fmt.Errorf("%w from 10.0.0.1:8081: 500", httpconn.ErrUnexpectedStatus):   ReasonProtocolError,
+		fmt.Errorf("%w from 10.0.0.1:8083", udpconn.ErrNoEchoes):                 ReasonTimeout,
+		io.EOF: ReasonEOF,
+		status.Error(codes.DeadlineExceeded, "deadline exceeded"): ReasonTimeout,
+		status.Error(codes.Unimplemented, "unknown method"):       ReasonProtocolError,
+		status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing: dial tcp 10.0.0.1:8082: connect: connection refused\""): ReasonRefused,
+		status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing: dial tcp 10.0.0.1:8082: i/o timeout\""):                 ReasonTimeout,
+		status.Error(codes.Unavailable, "error reading from server: read tcp 10.0.0.2:41000->10.0.0.1:8082: read: connection reset by peer"):                ReasonReset,
+		status.Error(codes.Unavailable, "error reading from server: EOF"):                                                                                   ReasonEOF,
+		status.Error(codes.Unknown, "something else"):          ReasonOther,
+		errors.New("Error while attempting to fetch TCP info"): ReasonOther,
+	}
+	for err, reason := range cases {
+		assert.Equal(t, reason, classify(err), err.Error())
+	}
+}
+
+// TestProbeLabels checks that outcomes are labelled with the peer as the test resolved it rather than as it was sent
+func TestProbeLabels(t *testing.T) {
+	p := peer.Peer{Dst: "10.0.0.1:8080", NodeName: "TestProbeLabels"}
+	resolved := p
+	resolved.Src = "10.0.0.2"
+	resolved.DstNode = "server"
+	send := func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		return resolved, nil
+	}
+	Probe(context.Background(), send, p, 10)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ProbeSuccessesCounterVec.WithLabelValues(resolved.Values()...)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(ProbeSuccessesCounterVec.WithLabelValues(p.Values()...)))
+}
@@ -0,0 +1,128 @@
+package srvendpoints
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn"
+)
+
+// Set up the results of idle timeout probes as metrics, which show whether load balancers or conntrack drop idle
+// flows sooner than application keepalives expect
+var (
+	// 1 if a connection left idle for idle_seconds still worked afterwards, 0 if not
+	IdleSurvivedGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_tcp_idle_survived_gauge",
+		},
+		peer.Labels("idle_seconds"),
+	)
+
+	// The longest a connection was left idle for and still worked, 0 if none did
+	MaxIdleGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_tcp_idle_max_survived_seconds_gauge",
+		},
+		peer.Labels(),
+	)
+)
+
+// IdleSender opens a connection for every duration in idle at once, leaves each idle for its duration and then
+// checks it still works. The size of the test doesn't matter, and it takes as long as the longest duration, though
+// it only counts against the concurrency limit while connecting
+func IdleSender(timeouts tcpconn.Timeouts, idle []time.Duration) SendFunc {
+	idle = append([]time.Duration(nil), idle...)
+	sort.Slice(idle, func(i, j int) bool { return idle[i] < idle[j] })
+	return func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		return probeIdle(ctx, p, timeouts, idle)
+	}
+}
+
+// probeIdle runs an idle timeout probe of p with every duration in idle, which is sorted, and returns p as the
+// connections describe it. Only failing to connect fails the probe, connections that die while idle are what it
+// measures. Each duration is recorded as soon as its connection has been checked, whether or not the others could be
+// opened
+func probeIdle(ctx context.Context, p peer.Peer, timeouts tcpconn.Timeouts, idle []time.Duration) (peer.Peer, error) {
+	conns := make([]*tcpconn.Persistent, len(idle))
+	errs := make([]error, len(idle))
+	var wg sync.WaitGroup
+	for i := range idle {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conns[i], errs[i] = tcpconn.DialPersistent(ctx, p, timeouts)
+		}(i)
+	}
+	wg.Wait()
+	var dialErr error
+	for i, err := range errs {
+		if err != nil {
+			log.Warning("Couldn't open connection to ", p.Dst, " to leave idle for ", idle[i], ": ", err)
+			if dialErr == nil {
+				dialErr = err
+			}
+		}
+	}
+	// From here on the probe only waits
+	FreeSlot(ctx)
+
+	survived := make([]bool, len(idle))
+	var described peer.Peer
+	for i, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		described = conn.Peer()
+		wg.Add(1)
+		go func(i int, conn *tcpconn.Persistent) {
+			defer wg.Done()
+			defer conn.Close()
+			survived[i] = checkIdle(ctx, conn, idle[i])
+		}(i, conn)
+	}
+	wg.Wait()
+	if described.Dst == "" {
+		// No connection opened, so there's no more known about p
+		described = p
+	} else if ctx.Err() == nil {
+		var longest time.Duration
+		for i, ok := range survived {
+			if ok {
+				longest = idle[i]
+			}
+		}
+		MaxIdleGaugeVec.WithLabelValues(described.Values()...).Set(longest.Seconds())
+	}
+	if err := ctx.Err(); err != nil {
+		return described, err
+	}
+	return described, dialErr
+}
+
+// checkIdle leaves conn idle for d, then records and returns whether it still works. Nothing is recorded if ctx is
+// done first, as then we gave up rather than the connection
+func checkIdle(ctx context.Context, conn *tcpconn.Persistent, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+	}
+	err := conn.Ping(ctx)
+	if ctx.Err() != nil {
+		return false
+	}
+	alive := 1.0
+	if err != nil {
+		log.Info("Connection to ", conn.Peer().Dst, " died after idling for ", d, ": ", classify(err))
+		alive = 0
+	}
+	idleSeconds := strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	IdleSurvivedGaugeVec.WithLabelValues(conn.Peer().Values(idleSeconds)...).Set(alive)
+	return err == nil
+}
@@ -0,0 +1,87 @@
+package srvendpoints
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/conntest/src/frame"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn"
+	"github.com/thought-machine/conntest/src/tcpconn/tcpconntest"
+)
+
+// TestIdleSender checks that connections dropped by something timing out idle flows are told apart from the rest
+func TestIdleSender(t *testing.T) {
+	addr := "127.0.0.1:9970"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// Drops connections that are idle for more than 100ms, as conntrack might
+	go tcpconntest.Server{
+		Hello: tcpconn.Hello{Version: tcpconn.ProtocolVersion}.Marshal(),
+		Accept: func(c net.Conn) bool {
+			return c.SetReadDeadline(time.Now().Add(100*time.Millisecond)) == nil
+		},
+		Handle: func(c net.Conn, n int, f frame.Frame) bool {
+			c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			return frame.Write(c, frame.Frame{Type: frame.TypeAck}) == nil
+		},
+	}.Serve(s)
+
+	send := IdleSender(tcpconn.ClientTimeouts, []time.Duration{300 * time.Millisecond, 10 * time.Millisecond})
+	p, err := send(context.Background(), peer.Peer{Dst: addr, NodeName: "TestIdleSender"}, 10)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "127.0.0.1", p.Src)
+	assert.Equal(t, 1.0, testutil.ToFloat64(IdleSurvivedGaugeVec.WithLabelValues(p.Values("0.01")...)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(IdleSurvivedGaugeVec.WithLabelValues(p.Values("0.3")...)))
+	assert.Equal(t, 0.01, testutil.ToFloat64(MaxIdleGaugeVec.WithLabelValues(p.Values()...)))
+}
+
+// TestIdleSenderDialFailure checks that the connections that could be opened are still measured when one couldn't
+func TestIdleSenderDialFailure(t *testing.T) {
+	addr := "127.0.0.1:9964"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// Hangs up on the first connection before saying hello
+	accepted := 0
+	go tcpconntest.Server{
+		Hello: tcpconn.Hello{Version: tcpconn.ProtocolVersion}.Marshal(),
+		Accept: func(c net.Conn) bool {
+			accepted++
+			return accepted > 1
+		},
+		Handle: func(c net.Conn, n int, f frame.Frame) bool {
+			return frame.Write(c, frame.Frame{Type: frame.TypeAck}) == nil
+		},
+	}.Serve(s)
+
+	idle := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}
+	send := IdleSender(tcpconn.ClientTimeouts, idle)
+	p, err := send(context.Background(), peer.Peer{Dst: addr, NodeName: "TestIdleSenderDialFailure"}, 10)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, "127.0.0.1", p.Src)
+	measured := testutil.ToFloat64(IdleSurvivedGaugeVec.WithLabelValues(p.Values("0.01")...)) +
+		testutil.ToFloat64(IdleSurvivedGaugeVec.WithLabelValues(p.Values("0.02")...))
+	assert.Equal(t, 1.0, measured)
+	assert.NotZero(t, testutil.ToFloat64(MaxIdleGaugeVec.WithLabelValues(p.Values()...)))
+}
+
+// TestIdleSenderUnreachable checks that the probe fails when it can't connect at all
+func TestIdleSenderUnreachable(t *testing.T) {
+	send := IdleSender(tcpconn.ClientTimeouts, []time.Duration{time.Millisecond})
+	_, err := send(context.Background(), peer.Peer{Dst: "127.0.0.1:9985"}, 10)
+	assert.Equal(t, ReasonRefused, classify(err))
+}
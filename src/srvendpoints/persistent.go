@@ -0,0 +1,96 @@
+package srvendpoints
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn"
+)
+
+// ConnectionDeathsHistVec is how old persistent connections were when a PING found them dead, and why
+var ConnectionDeathsHistVec = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name: "conntest_tcp_persistent_connection_age_at_death_seconds_hist",
+		// From a second to about 3 days
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	},
+	peer.Labels(
+		// One of the Reason constants
+		"reason",
+	),
+)
+
+// PersistentSender keeps one TCP connection open to every peer, sending a PING on it for every test instead of
+// opening a new one. A connection found dead is replaced on the next test
+type PersistentSender struct {
+	Timeouts tcpconn.Timeouts
+
+	mu    sync.Mutex
+	conns map[string]*tcpconn.Persistent
+}
+
+// Send pings the connection to p.Dst, opening it first if there isn't one, and returns p as the connection describes
+// it. The size of the test doesn't matter
+func (s *PersistentSender) Send(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+	conn := s.get(p.Dst)
+	if conn == nil {
+		var err error
+		conn, err = tcpconn.DialPersistent(ctx, p, s.Timeouts)
+		if err != nil {
+			return p, err
+		}
+		s.put(p.Dst, conn)
+	}
+	err := conn.Ping(ctx)
+	if err == nil {
+		return conn.Peer(), nil
+	}
+	s.remove(p.Dst, conn)
+	conn.Close()
+	if ctx.Err() != nil {
+		// Whatever went wrong, it was because we gave up on the test
+		err = ctx.Err()
+	}
+	if err != context.Canceled {
+		log.Warning("Persistent connection to ", p.Dst, " died after ", conn.Age(), ": ", err)
+		ConnectionDeathsHistVec.WithLabelValues(conn.Peer().Values(classify(err))...).Observe(conn.Age().Seconds())
+	}
+	return conn.Peer(), err
+}
+
+// Release closes the connection to p.Dst, once no more tests will be sent to it
+func (s *PersistentSender) Release(p peer.Peer) {
+	if conn := s.get(p.Dst); conn != nil {
+		s.remove(p.Dst, conn)
+		conn.Close()
+	}
+}
+
+// get returns the connection to address, nil if there isn't one
+func (s *PersistentSender) get(address string) *tcpconn.Persistent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns[address]
+}
+
+// put keeps conn as the connection to address
+func (s *PersistentSender) put(address string, conn *tcpconn.Persistent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[string]*tcpconn.Persistent)
+	}
+	s.conns[address] = conn
+}
+
+// remove forgets conn as the connection to address, unless it has already been replaced
+func (s *PersistentSender) remove(address string, conn *tcpconn.Persistent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[address] == conn {
+		delete(s.conns, address)
+	}
+}
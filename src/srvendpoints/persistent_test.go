@@ -0,0 +1,62 @@
+package srvendpoints
+
+import (
+	"context"
+	"net"
+
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/conntest/src/frame"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn"
+	"github.com/thought-machine/conntest/src/tcpconn/tcpconntest"
+)
+
+// TestPersistentSender checks that the connection to a peer is reused until it dies, which is recorded, and then
+// replaced
+func TestPersistentSender(t *testing.T) {
+	addr := "127.0.0.1:9971"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// Each connection answers two PINGs and then closes, as an idle timeout would
+	accepted := make(chan struct{}, 10)
+	go tcpconntest.Server{
+		Hello: tcpconn.Hello{Version: tcpconn.ProtocolVersion}.Marshal(),
+		Accept: func(c net.Conn) bool {
+			accepted <- struct{}{}
+			return true
+		},
+		Handle: func(c net.Conn, n int, f frame.Frame) bool {
+			return frame.Write(c, frame.Frame{Type: frame.TypeAck}) == nil && n < 1
+		},
+	}.Serve(s)
+
+	sender := &PersistentSender{Timeouts: tcpconn.ClientTimeouts}
+	p := peer.Peer{Dst: addr, NodeName: "TestPersistentSender"}
+	_, err = sender.Send(context.Background(), p, 10)
+	assert.Nil(t, err)
+	_, err = sender.Send(context.Background(), p, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(accepted))
+	dead, err := sender.Send(context.Background(), p, 10)
+	assert.NotNil(t, err)
+	assert.Equal(t, ReasonEOF, classify(err))
+
+	assert.Equal(t, "127.0.0.1", dead.Src)
+	var metric dto.Metric
+	ConnectionDeathsHistVec.WithLabelValues(dead.Values(ReasonEOF)...).(prometheus.Metric).Write(&metric)
+	assert.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+	_, err = sender.Send(context.Background(), p, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(accepted))
+
+	sender.Release(p)
+	assert.Nil(t, sender.get(addr))
+}
@@ -1,85 +1,90 @@
 package srvendpoints
 
 import (
-	"fmt"
-	"net"
-	"strconv"
+	"context"
 	"strings"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
+	"github.com/thought-machine/conntest/src/grpcconn"
+	"github.com/thought-machine/conntest/src/httpconn"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/pmtu"
 	"github.com/thought-machine/conntest/src/tcpconn"
+	"github.com/thought-machine/conntest/src/udpconn"
 )
 
 var log = logrus.New()
 
-// Counts number of failed SRV discoveries
-var (
-	TotalFailedSRVCounter = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "conntest_failed_SRV_discoveries_counter",
-		},
-	)
-)
+// SendFunc runs a single test of testBytes bytes against p.Dst, each protocol provides its own. It returns p as the
+// test labelled its metrics, with whatever it found out about either end filled in
+type SendFunc func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error)
+
+// slotKey is the context key of the func that frees a test's slot of a concurrency limit
+type slotKey struct{}
+
+// WithSlot returns a copy of ctx for a test that holds a slot of a concurrency limit, which free gives back. free must
+// be safe to call more than once
+func WithSlot(ctx context.Context, free func()) context.Context {
+	return context.WithValue(ctx, slotKey{}, free)
+}
 
-// DiscoverEndpoints uses SRV records to discover available endpoints
-func DiscoverEndpoints(service, protocol, name string, retryIntervalSecs float64, maxRetries int, failed int) ([]string, error) {
-	var err error
-	_, srv, serr := net.LookupSRV(service, protocol, name)
-	for serr != nil {
-		failed++
-		log.Debug("Failed SRV discovery attempts: ", failed)
-		TotalFailedSRVCounter.Add(1)
-		// Use maxRetries = -1 to retry indefinitely
-		if maxRetries == -1 {
-		} else if failed > maxRetries {
-			err = fmt.Errorf("Attempt to discover SRV record timed out after %v retries", (failed - 1))
-			return make([]string, 0), err
-		}
-		err = fmt.Errorf("Cannot find SRV record, retrying in %v seconds...(attempt %v)", retryIntervalSecs, failed)
+// FreeSlot gives back the concurrency slot of the test ctx is for, if it has one. Tests that spend most of their time
+// waiting rather than sending call it once they start waiting, so that other tests aren't held up by them
+func FreeSlot(ctx context.Context) {
+	if free, ok := ctx.Value(slotKey{}).(func()); ok {
+		free()
+	}
+}
+
+// Probe runs a single test using send, recording and logging how it went with the same labels as the test's own metrics
+func Probe(ctx context.Context, send SendFunc, p peer.Peer, testBytes int) {
+	p, err := send(ctx, p, testBytes)
+	if err != nil && ctx.Err() != nil {
+		// Whatever went wrong, it was because we gave up on the test
+		err = ctx.Err()
+	}
+	recordOutcome(p, err)
+	if err == context.Canceled {
+		log.Debug("Test to ", p.Dst, " cancelled")
+	} else if err != nil && strings.TrimSpace(err.Error()) != "EOF" {
 		log.Error(err)
-		// Only understands nanoseconds
-		ti := int64(1e9 * retryIntervalSecs)
-		log.Debug("Time between retries: ", float64(ti)/float64(1e9), " seconds")
-		time.Sleep(time.Duration(ti))
-		_, srv, serr = net.LookupSRV(service, protocol, name)
 	}
-	endpoints := make([]string, len(srv))
-	for i := 0; i < len(srv); i++ {
-		log.Debug("Available endpoints: ", srv[i].Target, ":", srv[i].Port)
-		endpoints[i] = srv[i].Target + ":" + strconv.Itoa(int(srv[i].Port))
+}
+
+// TCPSender sends packets over a new TCP connection for every test, each one in mode within timeouts
+func TCPSender(timeouts tcpconn.Timeouts, mode tcpconn.Mode) SendFunc {
+	return func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		return tcpconn.SendTCPConnectionWithin(ctx, p, testBytes, timeouts, mode)
 	}
-	log.Debug("Discovered endpoints: ", endpoints)
-	return endpoints, serr
 }
 
-// makethConnection is a supporting function for stacking up many concurrent connections using goroutines
-func makethConnection(ch chan bool, endpoint string, nodeName string, testBytes int) {
-	err := tcpconn.SendTCPConnection(endpoint, testBytes, nodeName)
-	if err != nil && strings.TrimSpace(err.Error()) != "EOF" {
-		log.Error(err)
+// GRPCSender runs the gRPC probe with msgCount streamed messages within timeouts
+func GRPCSender(timeouts tcpconn.Timeouts, msgCount int) SendFunc {
+	return func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		return grpcconn.SendGRPCRequestsWithin(ctx, p, testBytes, msgCount, timeouts)
 	}
-	ch <- true
-	return
 }
 
-// SendConcTCPConnections sends packets using concurrent sequential connections
-func SendConcTCPConnections(service string, protocol string, name string, nodeName string, testBytes int, retryIntervalSecs float64, maxRetries int) error {
-	ch := make(chan bool)
-	defer close(ch)
-	defer log.Debug("Channel closed")
-	endpoints, err := DiscoverEndpoints(service, protocol, name, retryIntervalSecs, maxRetries, 0)
-	if err != nil {
-		return err
+// UDPSender sends packetCount datagrams, intervalSecs apart
+func UDPSender(packetCount int, intervalSecs float64) SendFunc {
+	interval := time.Duration(1e9 * intervalSecs)
+	return func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		return udpconn.SendUDPProbes(ctx, p, testBytes, packetCount, interval)
 	}
-	for i := 0; i < len(endpoints); i++ {
-		go makethConnection(ch, endpoints[i], nodeName, testBytes)
+}
+
+// PMTUSender discovers the path MTU to the UDP responder, the size of the test doesn't matter
+func PMTUSender() SendFunc {
+	return func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		return pmtu.DiscoverPMTU(ctx, p)
 	}
-	// blocks further execution until connections to all endpoints are completed
-	for i := 0; i < len(endpoints); i++ {
-		_ = <-ch
+}
+
+// HTTPSender sends a HTTP request for every test within timeouts
+func HTTPSender(timeouts tcpconn.Timeouts) SendFunc {
+	return func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+		return httpconn.SendHTTPRequestWithin(ctx, p, testBytes, timeouts)
 	}
-	return err
 }
@@ -0,0 +1,143 @@
+package suites
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/thought-machine/conntest/src/config"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/scheduler"
+)
+
+var log = logrus.New()
+
+// Manager runs a scheduler for every suite, starting, stopping and restarting them as the suites change
+type Manager struct {
+	// New sets up the scheduler of suite, anything it starts should stop once ctx is done
+	New func(ctx context.Context, suite config.Suite) (*scheduler.Scheduler, error)
+
+	// Held for the whole of Apply, so that one change is made at a time
+	applying sync.Mutex
+	// Only held while looking at or changing what's running, as setting suites up can take a while
+	mu      sync.Mutex
+	idle    *sync.Cond
+	running map[string]*run
+	// Schedulers that haven't returned yet, including those stopped but still draining
+	active int
+}
+
+// run is the scheduler of one suite
+type run struct {
+	suite     config.Suite
+	scheduler *scheduler.Scheduler
+	// ctx is what the scheduler was set up with and runs until, stop cancels it
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// Apply makes the running suites match suites: new ones are started, removed ones are stopped and changed ones are
+// restarted, while those that haven't changed carry on untouched. Stopped schedulers finish their tests in flight.
+// Nothing is changed if any of the suites can't be set up. ctx and testCtx are passed on to the schedulers' Run
+func (m *Manager) Apply(ctx context.Context, testCtx context.Context, suites []config.Suite) error {
+	m.applying.Lock()
+	defer m.applying.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Set up every new or changed suite before touching the running ones
+	running := m.suites()
+	wanted := make(map[string]bool, len(suites))
+	var added []*run
+	for _, suite := range suites {
+		wanted[suite.Name] = true
+		if old, ok := running[suite.Name]; ok && reflect.DeepEqual(old, suite) {
+			continue
+		}
+		r := &run{suite: suite}
+		r.ctx, r.stop = context.WithCancel(ctx)
+		var err error
+		r.scheduler, err = m.New(r.ctx, suite)
+		if err != nil {
+			r.stop()
+			for _, r := range added {
+				r.stop()
+			}
+			return err
+		}
+		added = append(added, r)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		// Gave up while setting them up
+		for _, r := range added {
+			r.stop()
+		}
+		return err
+	}
+	if m.running == nil {
+		m.running = make(map[string]*run)
+		m.idle = sync.NewCond(&m.mu)
+	}
+	for name, r := range m.running {
+		if !wanted[name] {
+			log.Info("Stopping suite ", name)
+			r.stop()
+			delete(m.running, name)
+		}
+	}
+	for _, r := range added {
+		if old, ok := m.running[r.suite.Name]; ok {
+			log.Info("Restarting suite ", r.suite.Name)
+			old.stop()
+		} else {
+			log.Info("Starting suite ", r.suite.Name)
+		}
+		m.running[r.suite.Name] = r
+		m.active++
+		go m.run(r, testCtx)
+	}
+	return nil
+}
+
+// suites returns the suite of every running scheduler, by name
+func (m *Manager) suites() map[string]config.Suite {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	suites := make(map[string]config.Suite, len(m.running))
+	for name, r := range m.running {
+		suites[name] = r.suite
+	}
+	return suites
+}
+
+// run runs the scheduler of r until it returns or r is stopped. Once a suite that has been removed has finished,
+// its series are deleted
+func (m *Manager) run(r *run, testCtx context.Context) {
+	r.scheduler.Run(r.ctx, testCtx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Suites that have been changed are running again under the same name, so only removed ones are forgotten
+	if _, ok := m.running[r.suite.Name]; !ok {
+		deleted := peer.Forget(prometheus.Labels{"suite": r.suite.Name})
+		log.Debug("Deleted ", deleted, " series of suite ", r.suite.Name, " after it was removed")
+	}
+	m.active--
+	m.idle.Broadcast()
+}
+
+// Wait waits for every scheduler to return, either because ctx is done or because they have sent all their tests
+func (m *Manager) Wait() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.idle != nil && m.active > 0 {
+		m.idle.Wait()
+	}
+}
@@ -0,0 +1,193 @@
+package suites
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/conntest/src/config"
+	"github.com/thought-machine/conntest/src/discovery"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/scheduler"
+	"github.com/thought-machine/conntest/src/testplan"
+)
+
+var suiteGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "conntest_test_suite_gauge"}, peer.Labels())
+
+func init() {
+	peer.MustRegister(suiteGauge)
+}
+
+// recorder counts the schedulers set up and the tests sent for every suite
+type recorder struct {
+	mu    sync.Mutex
+	news  map[string]int
+	tests map[string]int
+	// Suites that New fails for
+	broken map[string]bool
+}
+
+func newRecorder() *recorder {
+	return &recorder{news: make(map[string]int), tests: make(map[string]int), broken: make(map[string]bool)}
+}
+
+func (r *recorder) new(ctx context.Context, suite config.Suite) (*scheduler.Scheduler, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.broken[suite.Name] {
+		return nil, errors.New("Broken suite")
+	}
+	r.news[suite.Name]++
+	return &scheduler.Scheduler{
+		Discoverer: discovery.NewStaticDiscoverer("a:1"),
+		Local:      peer.Peer{Suite: suite.Name},
+		Send: func(ctx context.Context, p peer.Peer, testBytes int) (peer.Peer, error) {
+			suiteGauge.WithLabelValues(p.Values()...).Set(float64(testBytes))
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.tests[suite.Name]++
+			return p, nil
+		},
+		Plan:              testplan.Plan{ShortBytes: suite.ShortTestBytes},
+		Wait:              func() time.Duration { return time.Millisecond },
+		DiscoveryInterval: 10 * time.Millisecond,
+	}, nil
+}
+
+func (r *recorder) get(counts map[string]int, name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return counts[name]
+}
+
+// eventually waits up to a second for cond to become true
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+// series counts the series of suiteGauge belonging to suite
+func series(suite string) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		suiteGauge.Collect(ch)
+		close(ch)
+	}()
+	n := 0
+	for m := range ch {
+		var metric dto.Metric
+		m.Write(&metric)
+		for _, label := range metric.Label {
+			if label.GetName() == "suite" && label.GetValue() == suite {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestApply(t *testing.T) {
+	r := newRecorder()
+	m := &Manager{New: r.new}
+	ctx, cancel := context.WithCancel(context.Background())
+	mesh := config.Suite{Name: "mesh", ShortTestBytes: 10}
+	large := config.Suite{Name: "large", ShortTestBytes: 1000}
+
+	assert.Nil(t, m.Apply(ctx, context.Background(), []config.Suite{mesh, large}))
+	assert.True(t, eventually(func() bool { return r.get(r.tests, "mesh") > 0 && r.get(r.tests, "large") > 0 }))
+
+	// Only the changed suite is set up again
+	large.ShortTestBytes = 2000
+	assert.Nil(t, m.Apply(ctx, context.Background(), []config.Suite{mesh, large}))
+	assert.Equal(t, 1, r.get(r.news, "mesh"))
+	assert.Equal(t, 2, r.get(r.news, "large"))
+
+	// A removed suite stops sending tests and its series are deleted
+	assert.Nil(t, m.Apply(ctx, context.Background(), []config.Suite{mesh}))
+	assert.True(t, eventually(func() bool { return series("large") == 0 }))
+	stopped := r.get(r.tests, "large")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, stopped, r.get(r.tests, "large"))
+	assert.Equal(t, 1, series("mesh"))
+
+	cancel()
+	finished := make(chan struct{})
+	go func() {
+		m.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Suites didn't stop once their context was cancelled")
+	}
+	assert.Error(t, m.Apply(ctx, context.Background(), []config.Suite{mesh}))
+}
+
+// TestApplyFailure checks that the running suites are left alone if any of the new ones can't be set up
+func TestApplyFailure(t *testing.T) {
+	r := newRecorder()
+	r.broken["broken"] = true
+	m := &Manager{New: r.new}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer m.Wait()
+	defer cancel()
+	mesh := config.Suite{Name: "mesh", ShortTestBytes: 10}
+
+	assert.Nil(t, m.Apply(ctx, context.Background(), []config.Suite{mesh}))
+	assert.Error(t, m.Apply(ctx, context.Background(), []config.Suite{{Name: "new", ShortTestBytes: 10}, {Name: "broken"}}))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, r.get(r.tests, "new"))
+	sent := r.get(r.tests, "mesh")
+	assert.True(t, eventually(func() bool { return r.get(r.tests, "mesh") > sent }))
+}
+
+// TestApplySlowSuite checks that a suite that is slow to set up doesn't hold up those already running
+func TestApplySlowSuite(t *testing.T) {
+	r := newRecorder()
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	m := &Manager{New: func(ctx context.Context, suite config.Suite) (*scheduler.Scheduler, error) {
+		if suite.Name == "slow" {
+			close(started)
+			<-unblock
+		}
+		return r.new(ctx, suite)
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	mesh := config.Suite{Name: "mesh", ShortTestBytes: 10}
+	assert.Nil(t, m.Apply(ctx, context.Background(), []config.Suite{mesh}))
+
+	applied := make(chan error)
+	go func() {
+		applied <- m.Apply(ctx, context.Background(), []config.Suite{mesh, {Name: "slow", ShortTestBytes: 10}})
+	}()
+	<-started
+	cancel()
+	finished := make(chan struct{})
+	go func() {
+		m.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Suites couldn't stop while another was being set up")
+	}
+
+	// It was given up on while it was being set up, so it never runs
+	close(unblock)
+	assert.Error(t, <-applied)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, r.get(r.tests, "slow"))
+}
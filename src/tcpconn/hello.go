@@ -0,0 +1,194 @@
+package tcpconn
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/thought-machine/conntest/src/peer"
+)
+
+// ProtocolVersion is sent in HELLO frames, peers that don't send one are taken to be version 0
+const ProtocolVersion = 4
+
+// framesVersion is the first version that switches from lines to length prefixed frames once both ends have said hello
+const framesVersion = 2
+
+// modesVersion is the first version that can echo payloads and send them itself, see Mode
+const modesVersion = 3
+
+// pingVersion is the first version that answers PING frames
+const pingVersion = 4
+
+// helloPrefix starts every HELLO frame, servers from before the handshake existed simply ACK it like any other data
+const helloPrefix = "HELLO"
+
+// maxHelloVersion is the highest version a HELLO may claim, versions end up as label values
+const maxHelloVersion = 255
+
+// helloValue is what the values of HELLO fields may hold: enough for node and pod names, zones, IPs and test IDs.
+// Servers use them as label values, so clients can't put arbitrary strings in their metrics
+var helloValue = regexp.MustCompile(`^[a-zA-Z0-9._:/-]{1,253}$`)
+
+// Identity describes this instance in the HELLO frames it sends, set it before serving or sending tests
+var Identity Hello
+
+// Hello is the identity exchanged by client and server when a connection opens
+type Hello struct {
+	Version  int
+	NodeName string
+	PodName  string
+	Zone     string
+	// Sent by clients: the source IP the client sees on its end of the connection
+	SrcIP string
+	// Sent by servers: the IP the server sees the client connecting from
+	ObservedIP string
+	// Sent by clients: identifies the test on both ends
+	TestID string
+}
+
+// Marshal encodes h as a single line of space separated key=value pairs after the HELLO prefix
+func (h Hello) Marshal() []byte {
+	fields := map[string]string{
+		"version":  strconv.Itoa(h.Version),
+		"node":     h.NodeName,
+		"pod":      h.PodName,
+		"zone":     h.Zone,
+		"src":      h.SrcIP,
+		"observed": h.ObservedIP,
+		"test":     h.TestID,
+	}
+	keys := make([]string, 0, len(fields))
+	for key, value := range fields {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(helloPrefix)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %v=%v", key, url.QueryEscape(fields[key]))
+	}
+	return []byte(b.String())
+}
+
+// IsHello reports whether line is a HELLO frame
+func IsHello(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == helloPrefix || strings.HasPrefix(line, helloPrefix+" ")
+}
+
+// ParseHello decodes a HELLO frame, keys it doesn't know are ignored so that newer peers can add them
+func ParseHello(line string) (Hello, error) {
+	if !IsHello(line) {
+		return Hello{}, errors.New("Not a HELLO frame: " + line)
+	}
+	var h Hello
+	for _, field := range strings.Fields(strings.TrimSpace(line))[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return Hello{}, errors.New("Malformed HELLO field: " + field)
+		}
+		value, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			return Hello{}, err
+		}
+		if !helloValue.MatchString(value) {
+			return Hello{}, errors.New("Malformed HELLO value of " + kv[0] + ": " + kv[1])
+		}
+		switch kv[0] {
+		case "version":
+			h.Version, err = strconv.Atoi(value)
+			if err != nil || h.Version < 0 || h.Version > maxHelloVersion {
+				return Hello{}, errors.New("Malformed HELLO version: " + value)
+			}
+		case "node":
+			h.NodeName = value
+		case "pod":
+			h.PodName = value
+		case "zone":
+			h.Zone = value
+		case "src":
+			h.SrcIP = value
+		case "observed":
+			h.ObservedIP = value
+		case "test":
+			h.TestID = value
+		}
+	}
+	return h, nil
+}
+
+// Set up server side metrics about the clients that say hello. Pod names are left out of the labels, as they would
+// make a new series every time a client restarts
+var (
+	ClientConnsCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conntest_server_client_connections_counter",
+		},
+		[]string{
+			// Identity the client sent
+			"src_node",
+			"src_zone",
+			// IP we see the client connecting from
+			"src_ip",
+			// Protocol version the client speaks
+			"version",
+		},
+	)
+
+	// 1 when the source IP a client sees differs from the one we see it connecting from, i.e. it is behind NAT
+	NATGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_server_client_nat_gauge",
+		},
+		[]string{
+			"src_node",
+			// IP we see the client connecting from
+			"src_ip",
+			// IP the client sees on its end
+			"client_ip",
+		},
+	)
+
+	// Protocol version of each server, 0 for servers from before the handshake
+	PeerVersionGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_tcp_peer_protocol_version_gauge",
+		},
+		peer.Labels(),
+	)
+)
+
+// helloReply builds the server's answer to the HELLO frame of client c
+func helloReply(c net.Conn, client Hello) Hello {
+	log.Debug("HELLO from ", client.NodeName, "/", client.PodName, " for test ", client.TestID)
+	reply := Identity
+	reply.Version = ProtocolVersion
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		reply.ObservedIP = addr.IP.String()
+	}
+	ClientConnsCounterVec.WithLabelValues(client.NodeName, client.Zone, reply.ObservedIP, strconv.Itoa(client.Version)).Inc()
+	if client.SrcIP != "" && reply.ObservedIP != "" {
+		nat := 0.0
+		if client.SrcIP != reply.ObservedIP {
+			nat = 1
+		}
+		NATGaugeVec.WithLabelValues(client.NodeName, reply.ObservedIP, client.SrcIP).Set(nat)
+	}
+	return reply
+}
+
+// newTestID returns a random identifier for one test
+func newTestID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
@@ -0,0 +1,136 @@
+package tcpconn
+
+import (
+	"bufio"
+	"net"
+	"strings"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHelloRoundTrip checks that every field survives marshalling, including ones needing escaping
+func TestHelloRoundTrip(t *testing.T) {
+	h := Hello{
+		Version:    ProtocolVersion,
+		NodeName:   "node-1",
+		PodName:    "conntest-abcde",
+		Zone:       "europe-west1-b",
+		SrcIP:      "fd00::1",
+		ObservedIP: "10.0.0.2",
+		TestID:     "0123456789abcdef",
+	}
+	parsed, err := ParseHello(string(h.Marshal()) + "\n")
+	assert.Nil(t, err)
+	assert.Equal(t, h, parsed)
+}
+
+// TestParseHello checks that unknown fields are ignored and malformed frames rejected
+func TestParseHello(t *testing.T) {
+	h, err := ParseHello("HELLO version=2 node=a future=thing")
+	assert.Nil(t, err)
+	assert.Equal(t, Hello{Version: 2, NodeName: "a"}, h)
+
+	_, err = ParseHello("HELLO version=x")
+	assert.NotNil(t, err)
+	_, err = ParseHello("HELLO node")
+	assert.NotNil(t, err)
+	_, err = ParseHello("aaaaaaaaaa")
+	assert.NotNil(t, err)
+	// Values end up in labels, so they are limited to what identities need
+	_, err = ParseHello("HELLO node=a%20b")
+	assert.NotNil(t, err)
+	_, err = ParseHello("HELLO node=" + strings.Repeat("a", 254))
+	assert.NotNil(t, err)
+	_, err = ParseHello("HELLO version=100000")
+	assert.NotNil(t, err)
+	assert.False(t, IsHello("HELLOaaaa"))
+}
+
+// TestHandshake says hello to a server and checks it answers with its identity and our address
+func TestHandshake(t *testing.T) {
+	addr := "127.0.0.1:9992"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	Identity = Hello{NodeName: "TestHandshake", Zone: "zone-a"}
+	defer func() { Identity = Hello{} }()
+
+	go DealWithTCPConnections(s)
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	session := newSession(c, ClientTimeouts)
+	server, err := session.handshake()
+	assert.Nil(t, err)
+	assert.Equal(t, ProtocolVersion, server.Version)
+	assert.Equal(t, "TestHandshake", server.NodeName)
+	assert.Equal(t, "zone-a", server.Zone)
+	assert.Equal(t, "127.0.0.1", server.ObservedIP)
+	assert.NotNil(t, session.frames)
+	assert.Nil(t, session.end())
+}
+
+// TestHandshakeLegacyServer checks that a server which ACKs everything is treated as version 0
+func TestHandshakeLegacyServer(t *testing.T) {
+	addr := "127.0.0.1:9991"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go func() {
+		c, err := s.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			c.Write([]byte("ACK\n"))
+		}
+	}()
+
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	session := newSession(c, ClientTimeouts)
+	server, err := session.handshake()
+	assert.Nil(t, err)
+	assert.Equal(t, Hello{}, server)
+	// Carries on speaking lines
+	assert.Nil(t, session.frames)
+	assert.Nil(t, session.send([]byte("aaaa")))
+}
+
+// TestLineClients checks that clients which don't say hello, or say hello from before frames, are still served lines
+func TestLineClients(t *testing.T) {
+	addr := "127.0.0.1:9981"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go DealWithTCPConnections(s)
+	for _, hello := range []string{"", "HELLO version=1 node=old"} {
+		c, err := net.Dial("tcp", addr)
+		assert.Nil(t, err)
+		r := bufio.NewReader(c)
+		if hello != "" {
+			reply, err := exchangeViaProtocol(c, r, []byte(hello), ClientTimeouts)
+			assert.Nil(t, err)
+			assert.True(t, IsHello(reply))
+		}
+		assert.Nil(t, sendViaProtocol(c, r, []byte("aaaa"), ClientTimeouts))
+		assert.Nil(t, sendViaProtocol(c, r, []byte("EOS"), ClientTimeouts))
+		c.Close()
+	}
+}
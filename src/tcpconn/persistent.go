@@ -0,0 +1,117 @@
+package tcpconn
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/thought-machine/conntest/src/peer"
+)
+
+// Set up metrics of connections kept open between tests, which notice conntrack timeouts, NAT rebinding and
+// middleboxes dropping idle flows that a new connection for every test never runs into
+var (
+	// From writing a PING to reading its ACK
+	PingHistVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "conntest_tcp_persistent_ping_seconds_hist",
+			Buckets: peer.LatencyBuckets,
+		},
+		peer.Labels(),
+	)
+
+	// How long the connection to each peer has been open as of its last successful PING
+	ConnectionAgeGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_tcp_persistent_connection_age_seconds_gauge",
+		},
+		peer.Labels(),
+	)
+)
+
+// Persistent is a test connection kept open to one peer, and checked with a PING on every test
+type Persistent struct {
+	c net.Conn
+	s *session
+	// The peer as described by its HELLO
+	p      peer.Peer
+	opened time.Time
+}
+
+// DialPersistent opens a connection to p.Dst and says hello, waiting no longer than timeouts for anything and giving
+// up as soon as ctx is done
+func DialPersistent(ctx context.Context, p peer.Peer, timeouts Timeouts) (*Persistent, error) {
+	// TCP keepalives would keep the flow alive in conntrack and middleboxes, hiding what this is here to find
+	dialer := net.Dialer{Timeout: timeouts.Connect, KeepAlive: -1}
+	c, err := dialer.DialContext(ctx, "tcp", p.Dst)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Persistent{c: c, s: newSession(c, timeouts), p: p, opened: time.Now()}
+	var server Hello
+	err = conn.within(ctx, func() error {
+		server, err = conn.s.handshake()
+		return err
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	log.Debug("Opened persistent connection to ", p.Dst, " from ", c.LocalAddr())
+	if conn.p.DstNode == "" {
+		conn.p.DstNode = server.NodeName
+	}
+	if conn.p.DstZone == "" {
+		conn.p.DstZone = server.Zone
+	}
+	if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		conn.p.Src = addr.IP.String()
+	}
+	// Outlives the test it was opened for, and PINGs are the same whatever size tests are
+	conn.p.TestSize = ""
+	PeerVersionGaugeVec.WithLabelValues(conn.p.Values()...).Set(float64(server.Version))
+	return conn, nil
+}
+
+// within runs f, closing the connection if ctx is done first so that f is interrupted
+func (conn *Persistent) within(ctx context.Context, f func() error) error {
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.c.Close()
+		case <-finished:
+		}
+	}()
+	return f()
+}
+
+// Ping checks that the connection still works, giving up as soon as ctx is done. The connection is no use after an
+// error and should be closed
+func (conn *Persistent) Ping(ctx context.Context) error {
+	sent := time.Now()
+	if err := conn.within(ctx, conn.s.ping); err != nil {
+		return err
+	}
+	PingHistVec.WithLabelValues(conn.p.Values()...).Observe(time.Since(sent).Seconds())
+	ConnectionAgeGaugeVec.WithLabelValues(conn.p.Values()...).Set(conn.Age().Seconds())
+	return nil
+}
+
+// Peer is the peer the connection was opened to, with what its HELLO said about it filled in
+func (conn *Persistent) Peer() peer.Peer {
+	return conn.p
+}
+
+// Age is how long the connection has been open
+func (conn *Persistent) Age() time.Duration {
+	return time.Since(conn.opened)
+}
+
+// Close closes the connection without waiting for the server
+func (conn *Persistent) Close() error {
+	return conn.c.Close()
+}
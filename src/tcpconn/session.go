@@ -0,0 +1,220 @@
+package tcpconn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/thought-machine/conntest/src/frame"
+)
+
+// session is the client end of a test connection. It speaks lines until the handshake shows that the server
+// understands frames, and frames from then on
+type session struct {
+	c net.Conn
+	// Every read goes through r, so that nothing buffered is lost when switching to frames
+	r *bufio.Reader
+	// Set once frames have been negotiated
+	frames *frame.Reader
+	// Protocol version of the server, known once it has said hello
+	version  int
+	timeouts Timeouts
+}
+
+// transfer is how long a test's data took to cross the connection each way, zero for a direction it wasn't sent in
+type transfer struct {
+	upload   time.Duration
+	download time.Duration
+}
+
+// newSession starts a session on c, waiting no longer than timeouts for anything
+func newSession(c net.Conn, timeouts Timeouts) *session {
+	return &session{c: c, r: bufio.NewReader(c), timeouts: timeouts}
+}
+
+// handshake says hello to the server, a server that answers with anything but HELLO predates the handshake
+// and is reported as version 0
+func (s *session) handshake() (Hello, error) {
+	hello := Identity
+	hello.Version = ProtocolVersion
+	hello.TestID = newTestID()
+	if addr, ok := s.c.LocalAddr().(*net.TCPAddr); ok {
+		hello.SrcIP = addr.IP.String()
+	}
+	reply, err := exchangeViaProtocol(s.c, s.r, hello.Marshal(), s.timeouts)
+	if err != nil {
+		return Hello{}, err
+	}
+	if !IsHello(reply) {
+		log.Debug("Server ", s.c.RemoteAddr(), " doesn't support HELLO")
+		return Hello{}, nil
+	}
+	server, err := ParseHello(reply)
+	if err != nil {
+		return Hello{}, err
+	}
+	s.version = server.Version
+	if server.Version >= framesVersion {
+		s.frames = frame.NewReader(s.r)
+	}
+	return server, nil
+}
+
+// payload returns size bytes of test data. Lines can't hold arbitrary bytes, but frames are sent random data that
+// won't compress, with room for a checksum
+func (s *session) payload(size int) []byte {
+	if s.frames == nil {
+		return []byte(strings.Repeat("a", size))
+	}
+	data := make([]byte, size, size+frame.ChecksumSize)
+	rand.New(rand.NewSource(rand.Int63())).Read(data)
+	return data
+}
+
+// test runs one test in mode, with size bytes of data. Servers that can't echo or send data are tested with mode
+// ModeAck instead, timing data on its way to them only
+func (s *session) test(mode Mode, size int) (transfer, error) {
+	if mode != ModeAck && (s.frames == nil || s.version < modesVersion) {
+		log.Debug("Server ", s.c.RemoteAddr(), " doesn't support ", mode, " tests, sending ", ModeAck, " instead")
+		mode = ModeAck
+	}
+	switch mode {
+	case ModeEcho:
+		return s.echo(s.payload(size))
+	case ModeServerSends:
+		return s.request(size)
+	default:
+		data := s.payload(size)
+		start := time.Now()
+		err := s.send(data)
+		return transfer{upload: time.Since(start)}, err
+	}
+}
+
+// send sends data and waits for the server to acknowledge it. Frames carry the checksum of data, and if the server
+// computed a different one ErrCorrupt is returned
+func (s *session) send(data []byte) error {
+	if s.frames == nil {
+		return sendViaProtocol(s.c, s.r, data, s.timeouts)
+	}
+	sum := frame.Checksum(data)
+	reply, err := s.exchange(frame.WithChecksum(frame.TypeData, data))
+	if err != nil {
+		return err
+	}
+	_, received, err := reply.SplitChecksum()
+	if err == frame.ErrNoChecksum {
+		// Servers from before checksums can't tell us what they received
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w from %v: %v", ErrUnexpectedReply, s.c.RemoteAddr(), err)
+	}
+	if received != sum {
+		return fmt.Errorf("%w to %v: checksum %08x, received as %08x", ErrCorrupt, s.c.RemoteAddr(), sum, received)
+	}
+	return nil
+}
+
+// echo sends data and reads it back from the server. Its upload time lasts until the echo starts arriving, so it
+// includes one round trip. The server echoes the checksum of what it received, so corruption on the way there is told
+// apart from corruption on the way back
+func (s *session) echo(data []byte) (transfer, error) {
+	sum := frame.Checksum(data)
+	start := time.Now()
+	reply, arrived, err := s.call(frame.WithChecksum(frame.TypeEcho, data), frame.TypeEcho)
+	if err != nil {
+		return transfer{}, err
+	}
+	t := transfer{upload: arrived.Sub(start), download: time.Since(arrived)}
+	echoed, received, err := reply.SplitChecksum()
+	if err != nil {
+		return t, fmt.Errorf("%w from %v: %v", ErrUnexpectedReply, s.c.RemoteAddr(), err)
+	}
+	if received != sum {
+		return t, fmt.Errorf("%w to %v: checksum %08x, received as %08x", ErrCorrupt, s.c.RemoteAddr(), sum, received)
+	}
+	if back := frame.Checksum(echoed); back != sum {
+		return t, fmt.Errorf("%w from %v: checksum %08x, echoed as %08x", ErrCorrupt, s.c.RemoteAddr(), sum, back)
+	}
+	return t, nil
+}
+
+// request asks the server to send size bytes of data, checked against the checksum they come with
+func (s *session) request(size int) (transfer, error) {
+	req := frame.Frame{Type: frame.TypeRequest, Payload: make([]byte, 4)}
+	binary.BigEndian.PutUint32(req.Payload, uint32(size))
+	reply, arrived, err := s.call(req, frame.TypeData)
+	if err != nil {
+		return transfer{}, err
+	}
+	t := transfer{download: time.Since(arrived)}
+	data, sent, err := reply.SplitChecksum()
+	if err != nil {
+		return t, fmt.Errorf("%w from %v: %v", ErrUnexpectedReply, s.c.RemoteAddr(), err)
+	}
+	if len(data) != size {
+		return t, fmt.Errorf("%w from %v: %v bytes, asked for %v", ErrUnexpectedReply, s.c.RemoteAddr(), len(data), size)
+	}
+	if received := frame.Checksum(data); received != sent {
+		return t, fmt.Errorf("%w from %v: checksum %08x, received as %08x", ErrCorrupt, s.c.RemoteAddr(), sent, received)
+	}
+	return t, nil
+}
+
+// ping checks that the connection still works. Servers that don't know PING are sent a byte of data instead
+func (s *session) ping() error {
+	if s.frames == nil || s.version < pingVersion {
+		return s.send(s.payload(1))
+	}
+	_, err := s.exchange(frame.Frame{Type: frame.TypePing})
+	return err
+}
+
+// end tells the server the test is over and waits for it to acknowledge that
+func (s *session) end() error {
+	if s.frames == nil {
+		return sendViaProtocol(s.c, s.r, []byte("EOS"), s.timeouts)
+	}
+	_, err := s.exchange(frame.Frame{Type: frame.TypeEOS})
+	return err
+}
+
+// exchange sends f and returns the server's acknowledgement of it
+func (s *session) exchange(f frame.Frame) (frame.Frame, error) {
+	reply, _, err := s.call(f, frame.TypeAck)
+	return reply, err
+}
+
+// call sends f and returns the server's reply to it, which must be of type want, along with when the reply started
+// arriving
+func (s *session) call(f frame.Frame, want frame.Type) (frame.Frame, time.Time, error) {
+	s.c.SetWriteDeadline(deadline(s.timeouts.Write))
+	if err := frame.Write(s.c, f); err != nil {
+		return frame.Frame{}, time.Time{}, err
+	}
+	s.c.SetReadDeadline(deadline(s.timeouts.Read))
+	err := s.frames.Wait()
+	arrived := time.Now()
+	var reply frame.Frame
+	if err == nil {
+		reply, err = s.frames.Read()
+	}
+	if err == frame.ErrTruncated {
+		return frame.Frame{}, arrived, fmt.Errorf("%w from %v", ErrShortRead, s.c.RemoteAddr())
+	}
+	if err != nil {
+		return frame.Frame{}, arrived, err
+	}
+	if reply.Type == frame.TypeError {
+		return frame.Frame{}, arrived, fmt.Errorf("%w from %v: %s", ErrUnexpectedReply, s.c.RemoteAddr(), reply.Payload)
+	}
+	if reply.Type != want {
+		return frame.Frame{}, arrived, fmt.Errorf("%w from %v: %v frame", ErrUnexpectedReply, s.c.RemoteAddr(), reply.Type)
+	}
+	return reply, arrived, nil
+}
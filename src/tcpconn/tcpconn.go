@@ -2,6 +2,8 @@ package tcpconn
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -9,15 +11,90 @@ import (
 	"net"
 	"os"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/brucespang/go-tcpinfo"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+
+	"github.com/thought-machine/conntest/src/frame"
+	"github.com/thought-machine/conntest/src/peer"
 )
 
 var log = logrus.New()
 
+// Timeouts bound each network operation of a test, zero means no limit
+type Timeouts struct {
+	Connect time.Duration
+	Read    time.Duration
+	Write   time.Duration
+}
+
+// RoundTrip is the longest sending something and waiting for the reply can take, zero if either has no limit
+func (t Timeouts) RoundTrip() time.Duration {
+	if t.Read == 0 || t.Write == 0 {
+		return 0
+	}
+	return t.Write + t.Read
+}
+
+// Total is the longest connecting and then a single round trip can take, zero if any of them has no limit
+func (t Timeouts) Total() time.Duration {
+	if t.Connect == 0 || t.RoundTrip() == 0 {
+		return 0
+	}
+	return t.Connect + t.RoundTrip()
+}
+
+// ClientTimeouts apply to tests sent without timeouts of their own, so that a black holed peer can't hang a test forever
+var ClientTimeouts = Timeouts{
+	Connect: 5 * time.Second,
+	Read:    5 * time.Second,
+	Write:   5 * time.Second,
+}
+
+// ServerLimits bound what a client can make the server do
+type ServerLimits struct {
+	// Largest test accepted from a client, so that one can't make the server allocate more memory than it has
+	MaxRequestBytes int
+	// How long to wait for the rest of a frame once it has started arriving, and for each reply to be written.
+	// Connect is unused
+	Timeouts Timeouts
+	// How long a connection can go without a test before it is closed. Persistent and idle timeout tests leave
+	// connections quiet for a long time, so it has to be longer than they do
+	Idle time.Duration
+}
+
+// DefaultServerLimits apply to connections served without limits of their own
+var DefaultServerLimits = ServerLimits{
+	MaxRequestBytes: 4 << 20,
+	Timeouts: Timeouts{
+		Read:  5 * time.Second,
+		Write: 5 * time.Second,
+	},
+	Idle: 2 * time.Hour,
+}
+
+// deadline returns when an operation starting now that may take up to timeout has to finish by
+func deadline(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+var (
+	// ErrShortRead is returned when the server closes the connection part way through a reply
+	ErrShortRead = errors.New("Connection closed part way through reply")
+	// ErrUnexpectedReply is returned when the server replies with something other than ACK
+	ErrUnexpectedReply = errors.New("Unexpected reply")
+	// ErrCorrupt is returned when the server received different data to what was sent
+	ErrCorrupt = errors.New("Payload corrupted in transit")
+	// ErrLineTooLong is returned when a client that doesn't speak frames sends a line longer than the server allows
+	ErrLineTooLong = errors.New("Line too long")
+)
+
 // Set up simple server side metrics to be exported
 var (
 	// Total number of connections handled by the server
@@ -28,281 +105,712 @@ var (
 	)
 )
 
+// Socket info is sampled twice per test, once the connection is dialled and again once everything sent has been
+// acknowledged
+const (
+	phaseHandshake = "handshake"
+	phaseTransfer  = "transfer"
+)
+
+// socketLabels are the labels of client side socket metrics
+var socketLabels = peer.Labels(
+	// Which snapshot the value comes from, handshake or transfer
+	"phase",
+)
+
 // Set up socket level statistics as metrics
 var (
 	RetransmitsCounterVec = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "conntest_tcp_retransmits_counter",
 		},
-		[]string{
-			// IP address of the target we are sending tests to
-			"dst_ip",
-			// IP address of the source the tests are being sent from
-			"src_ip",
-			// Name of current node
-			"node_name",
-		},
+		socketLabels,
 	)
 
 	SndMssGaugeVec = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "conntest_tcp_send_message_gauge",
 		},
-		[]string{
-			"dst_ip",
-			"src_ip",
-			"node_name",
-		},
+		socketLabels,
 	)
 
 	RcvMssGaugeVec = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "conntest_tcp_receive_message_gauge",
 		},
-		[]string{
-			"dst_ip",
-			"src_ip",
-			"node_name",
-		},
+		socketLabels,
 	)
 
 	LostPacketsCounterVec = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "conntest_tcp_lost_packets_counter",
 		},
-		[]string{
-			"dst_ip",
-			"src_ip",
-			"node_name",
-		},
+		socketLabels,
 	)
 
 	RetransCounterVec = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "conntest_tcp_retrans_counter",
 		},
-		[]string{
-			"dst_ip",
-			"src_ip",
-			"node_name",
-		},
+		socketLabels,
 	)
 
 	PmtuGaugeVec = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "conntest_tcp_pmtu_gauge",
 		},
-		[]string{
-			"dst_ip",
-			"src_ip",
-			"node_name",
-		},
+		socketLabels,
 	)
 
 	RttGaugeVec = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "conntest_tcp_round_trip_time_seconds_gauge",
 		},
-		[]string{
-			"dst_ip",
-			"src_ip",
-			"node_name",
-		},
+		socketLabels,
 	)
 
 	RttHistVec = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "conntest_tcp_round_trip_time_seconds_hist",
-			Buckets: prometheus.ExponentialBuckets(1e-9, 10, 10),
-		},
-		[]string{
-			"dst_ip",
-			"src_ip",
-			"node_name",
+			Buckets: peer.LatencyBuckets,
 		},
+		socketLabels,
 	)
 
 	RttVarGaugeVec = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "conntest_tcp_round_trip_time_variance_gauge",
 		},
-		[]string{
-			"dst_ip",
-			"src_ip",
-			"node_name",
-		},
+		socketLabels,
 	)
 
 	TotalRetransGaugeVec = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "conntest_tcp_total_retrans_gauge",
 		},
-		[]string{
-			"dst_ip",
-			"src_ip",
-			"node_name",
+		socketLabels,
+	)
+)
+
+// Set up the change in socket level statistics over the payload transfer as metrics
+var (
+	RetransDeltaGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_tcp_transfer_total_retrans_delta_gauge",
+		},
+		peer.Labels(),
+	)
+
+	LostDeltaGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_tcp_transfer_lost_packets_delta_gauge",
+		},
+		peer.Labels(),
+	)
+
+	RttDeltaGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_tcp_transfer_round_trip_time_delta_seconds_gauge",
+		},
+		peer.Labels(),
+	)
+)
+
+// Set up timings of the protocol itself as metrics, these include any delay added in userspace (by a sidecar proxy
+// for example) which the kernel's RTT estimate can't see
+var (
+	DialHistVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "conntest_tcp_dial_seconds_hist",
+			Buckets: peer.LatencyBuckets,
+		},
+		peer.Labels(),
+	)
+
+	// From writing the payload to reading the server's ACK of it, or all of its reply in modes other than ModeAck
+	PayloadRttHistVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "conntest_tcp_payload_round_trip_seconds_hist",
+			Buckets: peer.TransferBuckets,
+		},
+		peer.Labels(),
+	)
+
+	// From starting to dial to the server's ACK of EOS
+	LifetimeHistVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "conntest_tcp_connection_lifetime_seconds_hist",
+			Buckets: peer.TransferBuckets,
+		},
+		peer.Labels(),
+	)
+)
+
+// Set up the throughput of test data in each direction, so that problems affecting only one of them such as
+// asymmetric MTUs or policing stand out. Uploads include a round trip waiting for the server to start answering
+var (
+	TransferHistVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "conntest_tcp_transfer_seconds_hist",
+			Buckets: peer.TransferBuckets,
+		},
+		peer.Labels("direction"),
+	)
+
+	ThroughputGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_tcp_throughput_bytes_per_second_gauge",
+		},
+		peer.Labels("direction"),
+	)
+)
+
+// Values of the direction label
+const (
+	directionUpload   = "upload"
+	directionDownload = "download"
+)
+
+// recordTransfer records taking d to send size bytes in direction, nothing is recorded if none were sent that way
+func recordTransfer(p peer.Peer, direction string, size int, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	TransferHistVec.WithLabelValues(p.Values(direction)...).Observe(d.Seconds())
+	ThroughputGaugeVec.WithLabelValues(p.Values(direction)...).Set(float64(size) / d.Seconds())
+}
+
+// CorruptPayloadsCounterVec counts payloads the server received differently to how they were sent, as NIC offload
+// bugs can cause without anything else noticing
+var CorruptPayloadsCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "conntest_tcp_corrupt_payloads_counter",
+	},
+	peer.Labels(),
+)
+
+// HostAddressesGaugeVec is always 1, with a series for every address the host name of this instance resolves to
+var HostAddressesGaugeVec = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "conntest_host_addresses_info",
+	},
+	[]string{
+		"hostname",
+		"ip",
+	},
+)
+
+// RecordHostAddresses looks up the addresses of the host name of this instance and records them, it only needs to
+// be called once at startup
+func RecordHostAddresses() error {
+	localHostName, err := os.Hostname()
+	if err != nil {
+		errMsg := "Error while attempting to look up local host name: " + err.Error()
+		err = errors.New(errMsg)
+		return err
+	}
+	localIPs, err := net.LookupHost(localHostName)
+	if err != nil {
+		errMsg := "Error while attempting to look up local IP address: " + err.Error()
+		err = errors.New(errMsg)
+		return err
+	}
+	log.Debug("Discovered IPs: ", localIPs)
+	for _, IP := range localIPs {
+		HostAddressesGaugeVec.WithLabelValues(localHostName, IP).Set(1)
+	}
+	return nil
+}
+
+// serverLabels are the labels of server side socket metrics, identifying the client from its HELLO. Pod names are
+// left out, as they would make a new series every time a client restarts
+var serverLabels = []string{
+	"src_node",
+	"src_zone",
+	// IP we see the client connecting from
+	"src_ip",
+}
+
+// Set up server side socket level statistics as metrics, so that problems in only one direction show up
+var (
+	ServerRetransmitsCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conntest_server_tcp_retransmits_counter",
+		},
+		serverLabels,
+	)
+
+	ServerRcvMssGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_server_tcp_receive_message_gauge",
+		},
+		serverLabels,
+	)
+
+	ServerRttGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_server_tcp_round_trip_time_seconds_gauge",
+		},
+		serverLabels,
+	)
+
+	ServerRttHistVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "conntest_server_tcp_round_trip_time_seconds_hist",
+			Buckets: peer.LatencyBuckets,
+		},
+		serverLabels,
+	)
+
+	// Payloads whose checksum didn't match what the client sent
+	ServerCorruptPayloadsCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conntest_server_tcp_corrupt_payloads_counter",
 		},
+		serverLabels,
 	)
 )
 
-// HandleTCPConnection deals with our TCP based protocol, closes the connection once it finishes serving the client
+// HandleTCPConnection deals with our TCP based protocol within DefaultServerLimits, closes the connection once it
+// finishes serving the client
 func HandleTCPConnection(c net.Conn) error {
+	return HandleTCPConnectionWithin(c, DefaultServerLimits)
+}
+
+// HandleTCPConnectionWithin deals with our TCP based protocol within limits, closes the connection once it finishes
+// serving the client
+func HandleTCPConnectionWithin(c net.Conn, limits ServerLimits) error {
 	log.Debug("Serving ", c.RemoteAddr().String())
-	var err error
 	defer log.Debug("Finished serving ", c.RemoteAddr().String())
+	defer c.Close()
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		// Keeps the server side series of the client from being deleted as stale
+		peer.SeenClient(addr.IP.String())
+	}
+	// Every read goes through r, so that nothing buffered is lost when switching to frames
+	r := bufio.NewReader(c)
+	// Clients from before the handshake never say who they are
+	var client Hello
+	// What the socket had counted when it was last sampled
+	var sampled syscall.TCPInfo
 	for {
-		data, err := ReceiveViaProtocol(c)
-		if (err != nil) && (err != io.EOF) {
+		line, err := receiveViaProtocol(c, r, limits)
+		if err == io.EOF {
+			// Includes readiness and liveness probes, which connect without sending anything
+			return nil
+		}
+		if err != nil {
 			log.Error(err)
-			break
+			return err
 		}
 
-		temp := strings.TrimSpace(string(data))
-		if temp == "EOS" {
-			break
+		if line == "EOS" {
+			return nil
+		}
+		if IsHello(line) {
+			client, _ = ParseHello(line)
+			if client.Version >= framesVersion {
+				err := serveFrames(c, r, client, limits, &sampled)
+				if err != nil {
+					log.Error(err)
+				}
+				return err
+			}
+		} else if line != "" {
+			// The test data has been exchanged, so the socket has seen traffic both ways
+			if err := recordServerTCPInfo(c, client, &sampled); err != nil {
+				log.Debug(err)
+			}
 		}
 	}
-	return err
 }
 
-// DealWithTCPConnections ensures we can deal with multiple clients without blocking
+// serveFrames serves a client that has switched to frames after saying hello within limits, until it sends EOS.
+// sampled is what the socket had counted when it was last sampled
+func serveFrames(c net.Conn, r *bufio.Reader, client Hello, limits ServerLimits, sampled *syscall.TCPInfo) error {
+	frames := frame.NewReader(r)
+	frames.MaxPayload = limits.MaxRequestBytes + frame.ChecksumSize
+	for {
+		c.SetReadDeadline(deadline(limits.Idle))
+		err := frames.Wait()
+		var f frame.Frame
+		if err == nil {
+			c.SetReadDeadline(deadline(limits.Timeouts.Read))
+			f, err = frames.Read()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, frame.ErrTooLarge) {
+			// The rest of the frame is still on its way, so the connection can't be used for anything else
+			writeFrame(c, errorFrame(err.Error()), limits.Timeouts)
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading frame from %v: %w", c.RemoteAddr(), err)
+		}
+		ConnsHandledTotal.Inc()
+		switch f.Type {
+		case frame.TypeData:
+			if err := writeFrame(c, ackOf(c, f, client), limits.Timeouts); err != nil {
+				return err
+			}
+			// The test data has been exchanged, so the socket has seen traffic both ways
+			if err := recordServerTCPInfo(c, client, sampled); err != nil {
+				log.Debug(err)
+			}
+		case frame.TypeEcho:
+			data, _, err := f.SplitChecksum()
+			if err != nil {
+				return fmt.Errorf("Unchecked %v frame from %v: %w", f.Type, c.RemoteAddr(), err)
+			}
+			checkPayload(c, f, client)
+			// The trailer is overwritten with the checksum of what we received
+			if err := writeFrame(c, frame.WithChecksum(frame.TypeEcho, data), limits.Timeouts); err != nil {
+				return err
+			}
+			if err := recordServerTCPInfo(c, client, sampled); err != nil {
+				log.Debug(err)
+			}
+		case frame.TypeRequest:
+			if len(f.Payload) != 4 {
+				return fmt.Errorf("Malformed %v frame from %v: %v bytes", f.Type, c.RemoteAddr(), len(f.Payload))
+			}
+			size := binary.BigEndian.Uint32(f.Payload)
+			if int64(size) > int64(limits.MaxRequestBytes) {
+				log.Warningf("Rejected %v from %v for %v bytes", f.Type, c.RemoteAddr(), size)
+				reason := fmt.Sprintf("%v bytes asked for, at most %v are sent", size, limits.MaxRequestBytes)
+				if err := writeFrame(c, errorFrame(reason), limits.Timeouts); err != nil {
+					return err
+				}
+				continue
+			}
+			data := make([]byte, size, size+frame.ChecksumSize)
+			rand.New(rand.NewSource(rand.Int63())).Read(data)
+			if err := writeFrame(c, frame.WithChecksum(frame.TypeData, data), limits.Timeouts); err != nil {
+				return err
+			}
+			if err := recordServerTCPInfo(c, client, sampled); err != nil {
+				log.Debug(err)
+			}
+		case frame.TypePing:
+			if err := writeFrame(c, frame.Frame{Type: frame.TypeAck}, limits.Timeouts); err != nil {
+				return err
+			}
+		case frame.TypeEOS:
+			return writeFrame(c, frame.Frame{Type: frame.TypeAck}, limits.Timeouts)
+		default:
+			return fmt.Errorf("Unexpected %v frame from %v", f.Type, c.RemoteAddr())
+		}
+	}
+}
+
+// writeFrame writes f to the client c, waiting no longer than timeouts
+func writeFrame(c net.Conn, f frame.Frame, timeouts Timeouts) error {
+	c.SetWriteDeadline(deadline(timeouts.Write))
+	return frame.Write(c, f)
+}
+
+// errorFrame builds an ERROR frame saying why the client's last frame was refused
+func errorFrame(reason string) frame.Frame {
+	return frame.Frame{Type: frame.TypeError, Payload: []byte(reason)}
+}
+
+// ackOf builds the ACK of the data frame f from client c. Payloads with a checksum are verified, and the ACK carries
+// the checksum of what was received so that the client can tell too
+func ackOf(c net.Conn, f frame.Frame, client Hello) frame.Frame {
+	if f.Flags&frame.FlagChecksum == 0 {
+		return frame.Frame{Type: frame.TypeAck}
+	}
+	ack := frame.Frame{Type: frame.TypeAck, Flags: frame.FlagChecksum, Payload: make([]byte, frame.ChecksumSize)}
+	binary.BigEndian.PutUint32(ack.Payload, checkPayload(c, f, client))
+	return ack
+}
+
+// checkPayload verifies the checksum of the frame f from client c, counting it if it doesn't match, and returns the
+// checksum of what was received
+func checkPayload(c net.Conn, f frame.Frame, client Hello) uint32 {
+	data, sent, err := f.SplitChecksum()
+	var received uint32
+	if err == nil {
+		received = frame.Checksum(data)
+	}
+	if err != nil || received != sent {
+		var clientIP string
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			clientIP = addr.IP.String()
+		}
+		log.Warningf("Corrupt payload from %v: checksum %08x, sent as %08x", c.RemoteAddr(), received, sent)
+		ServerCorruptPayloadsCounterVec.WithLabelValues(client.NodeName, client.Zone, clientIP).Inc()
+	}
+	return received
+}
+
+// recordServerTCPInfo samples TCP_INFO on the accepted connection c and records it against client. Counts only add
+// what the socket has counted since sampled, which is then replaced with this sample
+func recordServerTCPInfo(c net.Conn, client Hello, sampled *syscall.TCPInfo) error {
+	socketInfo, err := tcpinfo.GetsockoptTCPInfo(&c)
+	if err != nil {
+		return errors.New("Error while attempting to fetch server side TCP info: " + err.Error())
+	}
+	prev := *sampled
+	*sampled = *socketInfo
+	var clientIP string
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP.String()
+	}
+	labels := []string{client.NodeName, client.Zone, clientIP}
+	ServerRetransmitsCounterVec.WithLabelValues(labels...).Add(increase(socketInfo.Total_retrans, prev.Total_retrans))
+	ServerRcvMssGaugeVec.WithLabelValues(labels...).Set(float64(socketInfo.Rcv_mss))
+	ServerRttGaugeVec.WithLabelValues(labels...).Set(seconds(socketInfo.Rtt))
+	ServerRttHistVec.WithLabelValues(labels...).Observe(seconds(socketInfo.Rtt))
+	return nil
+}
+
+// increase is how much a count from TCP_INFO went up by between samples. Some only count what is currently
+// outstanding, those that went down didn't go up at all
+func increase(now, prev uint32) float64 {
+	if now < prev {
+		return 0
+	}
+	return float64(now - prev)
+}
+
+// seconds converts a time from TCP_INFO, which are in microseconds
+func seconds(us uint32) float64 {
+	return float64(us) / 1e6
+}
+
+// DealWithTCPConnections ensures we can deal with multiple clients without blocking, serving each within
+// DefaultServerLimits
 func DealWithTCPConnections(s net.Listener) error {
+	return DealWithTCPConnectionsWithin(s, DefaultServerLimits)
+}
+
+// DealWithTCPConnectionsWithin ensures we can deal with multiple clients without blocking, serving each within limits
+func DealWithTCPConnectionsWithin(s net.Listener, limits ServerLimits) error {
 	for {
 		c, err := s.Accept()
 		if err != nil {
 			log.Debug("Error accepting connection: ", err)
 			return err
 		}
-		go HandleTCPConnection(c)
+		go HandleTCPConnectionWithin(c, limits)
 	}
 }
 
-// SendTCPConnection sends bytesToSend bytes to destHost
-func SendTCPConnection(destHost string, bytesToSend int, nodeName string) error {
-	c, err := net.Dial("tcp", destHost)
+// Mode is which way a test's data crosses the connection
+type Mode string
+
+// Test modes
+const (
+	// ModeAck sends data to the server, which only acknowledges it
+	ModeAck Mode = "ack"
+	// ModeEcho sends data to the server, which sends it back
+	ModeEcho Mode = "echo"
+	// ModeServerSends asks the server to send the data
+	ModeServerSends Mode = "server_sends"
+)
+
+// SendTCPConnection sends bytesToSend bytes to p.Dst within ClientTimeouts, giving up as soon as ctx is done
+func SendTCPConnection(ctx context.Context, p peer.Peer, bytesToSend int) error {
+	_, err := SendTCPConnectionWithin(ctx, p, bytesToSend, ClientTimeouts, ModeAck)
+	return err
+}
+
+// SendTCPConnectionWithin moves bytesToSend bytes between us and p.Dst as mode says within timeouts, giving up as soon
+// as ctx is done. It returns p as its metrics are labelled, with the source address and where the server runs filled
+// in as far as the test got
+func SendTCPConnectionWithin(ctx context.Context, p peer.Peer, bytesToSend int, timeouts Timeouts, mode Mode) (peer.Peer, error) {
+	start := time.Now()
+	dialer := net.Dialer{Timeout: timeouts.Connect}
+	c, err := dialer.DialContext(ctx, "tcp", p.Dst)
 	if err != nil {
-		return err
+		return p, err
 	}
+	// Closing the connection interrupts whatever is reading or writing it
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-finished:
+		}
+	}()
+	dialled := time.Now()
 	log.Debug("Local addr: ", c.LocalAddr())
-	defer log.Debug("Client finished sending to ", destHost)
+	defer log.Debug("Client finished sending to ", p.Dst)
 	defer c.Close()
 
-	// Query for socket info
-	socketInfo, err := tcpinfo.GetsockoptTCPInfo(&c)
+	// Query for socket info straight away, so that it only covers the TCP handshake
+	handshakeInfo, err := tcpinfo.GetsockoptTCPInfo(&c)
 	if err != nil {
 		errMsg := "Error while attempting to fetch TCP info: " + err.Error()
 		err = errors.New(errMsg)
-		return err
+		return p, err
 	}
 
-	// Get local IPs to be registered as a Prometheus label
-	localHostName, err := os.Hostname()
+	// Discovery doesn't always know where the server runs, but the server does
+	s := newSession(c, timeouts)
+	server, err := s.handshake()
 	if err != nil {
-		errMsg := "Error while attempting to look up local host name: " + err.Error()
-		err = errors.New(errMsg)
-		return err
+		return p, err
+	}
+	if p.DstNode == "" {
+		p.DstNode = server.NodeName
+	}
+	if p.DstZone == "" {
+		p.DstZone = server.Zone
+	}
+
+	// The address this connection actually leaves from, rather than every address of the host
+	if addr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		p.Src = addr.IP.String()
+	}
+
+	recordTCPInfo(p, phaseHandshake, handshakeInfo, &syscall.TCPInfo{})
+	PeerVersionGaugeVec.WithLabelValues(p.Values()...).Set(float64(server.Version))
+
+	t, err := s.test(mode, bytesToSend)
+	if errors.Is(err, ErrCorrupt) {
+		CorruptPayloadsCounterVec.WithLabelValues(p.Values()...).Inc()
 	}
-	localIPs, err := net.LookupHost(localHostName)
 	if err != nil {
-		errMsg := "Error while attempting to look up local IP address: " + err.Error()
-		err = errors.New(errMsg)
-		return err
+		return p, err
 	}
-	var localIPsBuilder strings.Builder
-	for _, IP := range localIPs {
-		fmt.Fprintf(&localIPsBuilder, "%v, ", IP)
-	}
-	localIPsStr := localIPsBuilder.String()
-	log.Debug("Discovered IPs: ", localIPsStr)
-
-	// Register relevant socket info
-	RetransmitsCounterVec.WithLabelValues(destHost, localIPsStr, nodeName).Add(float64(socketInfo.Retransmits))
-	SndMssGaugeVec.WithLabelValues(destHost, localIPsStr, nodeName).Set(float64(socketInfo.Snd_mss))
-	RcvMssGaugeVec.WithLabelValues(destHost, localIPsStr, nodeName).Set(float64(socketInfo.Rcv_mss))
-	LostPacketsCounterVec.WithLabelValues(destHost, localIPsStr, nodeName).Add(float64(socketInfo.Lost))
-	RetransCounterVec.WithLabelValues(destHost, localIPsStr, nodeName).Add(float64(socketInfo.Retrans))
-	PmtuGaugeVec.WithLabelValues(destHost, localIPsStr, nodeName).Set(float64(socketInfo.Pmtu))
-	RttGaugeVec.WithLabelValues(destHost, localIPsStr, nodeName).Set(float64(socketInfo.Rtt) / 1e9)
-	RttHistVec.WithLabelValues(destHost, localIPsStr, nodeName).Observe(float64(socketInfo.Rtt) / 1e9)
-	RttVarGaugeVec.WithLabelValues(destHost, localIPsStr, nodeName).Set(float64(socketInfo.Rttvar))
-	TotalRetransGaugeVec.WithLabelValues(destHost, localIPsStr, nodeName).Set(float64(socketInfo.Total_retrans))
-
-	strToSend := strings.Repeat("a", bytesToSend)
-	err = SendViaProtocol(c, []byte(strToSend))
+	err = s.end()
 	if err != nil {
-		return err
+		return p, err
 	}
-	err = SendViaProtocol(c, []byte("EOS"))
+	closed := time.Now()
+
+	DialHistVec.WithLabelValues(p.Values()...).Observe(dialled.Sub(start).Seconds())
+	PayloadRttHistVec.WithLabelValues(p.Values()...).Observe((t.upload + t.download).Seconds())
+	recordTransfer(p, directionUpload, bytesToSend, t.upload)
+	recordTransfer(p, directionDownload, bytesToSend, t.download)
+	LifetimeHistVec.WithLabelValues(p.Values()...).Observe(closed.Sub(start).Seconds())
+
+	// Everything has been acknowledged, so this covers the whole transfer
+	transferInfo, err := tcpinfo.GetsockoptTCPInfo(&c)
 	if err != nil {
-		return err
+		errMsg := "Error while attempting to fetch TCP info: " + err.Error()
+		err = errors.New(errMsg)
+		return p, err
 	}
-	return err
+	recordTCPInfo(p, phaseTransfer, transferInfo, handshakeInfo)
+	RetransDeltaGaugeVec.WithLabelValues(p.Values()...).Set(float64(transferInfo.Total_retrans) - float64(handshakeInfo.Total_retrans))
+	LostDeltaGaugeVec.WithLabelValues(p.Values()...).Set(float64(transferInfo.Lost) - float64(handshakeInfo.Lost))
+	RttDeltaGaugeVec.WithLabelValues(p.Values()...).Set(seconds(transferInfo.Rtt) - seconds(handshakeInfo.Rtt))
+	return p, err
 }
 
-// SendViaProtocol sends data over connection c using our custom protocol
+// recordTCPInfo registers the socket info of a test to p, sampled at the end of phase. Counts only add what the socket
+// has counted since prev, the sample of the phase before
+func recordTCPInfo(p peer.Peer, phase string, socketInfo *syscall.TCPInfo, prev *syscall.TCPInfo) {
+	values := p.Values(phase)
+	RetransmitsCounterVec.WithLabelValues(values...).Add(increase(uint32(socketInfo.Retransmits), uint32(prev.Retransmits)))
+	SndMssGaugeVec.WithLabelValues(values...).Set(float64(socketInfo.Snd_mss))
+	RcvMssGaugeVec.WithLabelValues(values...).Set(float64(socketInfo.Rcv_mss))
+	LostPacketsCounterVec.WithLabelValues(values...).Add(increase(socketInfo.Lost, prev.Lost))
+	RetransCounterVec.WithLabelValues(values...).Add(increase(socketInfo.Retrans, prev.Retrans))
+	PmtuGaugeVec.WithLabelValues(values...).Set(float64(socketInfo.Pmtu))
+	RttGaugeVec.WithLabelValues(values...).Set(seconds(socketInfo.Rtt))
+	RttHistVec.WithLabelValues(values...).Observe(seconds(socketInfo.Rtt))
+	RttVarGaugeVec.WithLabelValues(values...).Set(seconds(socketInfo.Rttvar))
+	TotalRetransGaugeVec.WithLabelValues(values...).Set(float64(socketInfo.Total_retrans))
+}
+
+// SendViaProtocol sends data over connection c as a single line, as done by clients that haven't said hello
 func SendViaProtocol(c net.Conn, data []byte) error {
+	return sendViaProtocol(c, bufio.NewReader(c), data, ClientTimeouts)
+}
+
+// sendViaProtocol sends data over connection c as a single line and checks that it is acknowledged, reading the
+// reply from r and waiting no longer than timeouts
+func sendViaProtocol(c net.Conn, r *bufio.Reader, data []byte, timeouts Timeouts) error {
+	reply, err := exchangeViaProtocol(c, r, data, timeouts)
+	if err != nil {
+		return err
+	}
+	if reply != "ACK" {
+		return fmt.Errorf("%w from %v: %q", ErrUnexpectedReply, c.RemoteAddr(), reply)
+	}
+	return nil
+}
+
+// exchangeViaProtocol sends data over connection c as a single line and returns the server's reply read from r,
+// waiting no longer than timeouts
+func exchangeViaProtocol(c net.Conn, r *bufio.Reader, data []byte, timeouts Timeouts) (string, error) {
 
 	dataWNL := append(data, '\n')
 	log.Debug("Client sent: ", string(dataWNL))
 
 	// Writes to and receives from server
+	c.SetWriteDeadline(deadline(timeouts.Write))
 	_, err := c.Write(dataWNL)
 	if err != nil {
-		return err
+		return "", err
 	}
-	netData, err := bufio.NewReader(c).ReadString('\n')
+	c.SetReadDeadline(deadline(timeouts.Read))
+	netData, err := r.ReadString('\n')
 	log.Debug(":", netData, ":")
 	tempNetdata := strings.TrimSpace(string(netData))
-	if err != nil {
-		return err
+	if err == io.EOF && netData != "" {
+		return tempNetdata, fmt.Errorf("%w from %v", ErrShortRead, c.RemoteAddr())
 	}
-	if tempNetdata == "ACK" {
-		err = nil
+	if err != nil {
+		return tempNetdata, err
 	}
 	log.Debug("Client finished sending to ", c.RemoteAddr())
-	return err
+	return tempNetdata, err
 }
 
-// ReceiveViaProtocol runs on server with HandleTCPConnection to receive messages
-// from clients via our custom protocol
-func ReceiveViaProtocol(c net.Conn) (string, error) {
-	log.Debug("Server receiving from ", c.RemoteAddr().String(), "\n")
+// receiveViaProtocol runs on server with HandleTCPConnection to receive a line from clients via our custom
+// protocol, read from r. Every line is acknowledged, HELLO with our own identity
+func receiveViaProtocol(c net.Conn, r *bufio.Reader, limits ServerLimits) (string, error) {
+	log.Debug("Server receiving from ", c.RemoteAddr().String())
 
-	netData, err := bufio.NewReader(c).ReadString('\n')
+	c.SetReadDeadline(deadline(limits.Idle))
+	netData, err := readLine(r, limits.MaxRequestBytes)
 	log.Debug("Server received: ", netData)
-
-	if (err != nil) && (err != io.EOF) {
+	if err != nil {
 		// Down to debug level as we don't care whether the client stops sending
 		log.Debug(err)
 		return "", err
 	}
 
 	result := "ACK\n"
-	c.Write([]byte(string(result)))
+	if IsHello(netData) {
+		client, err := ParseHello(netData)
+		if err != nil {
+			log.Debug("Bad HELLO from ", c.RemoteAddr().String(), ": ", err)
+		}
+		result = string(helloReply(c, client).Marshal()) + "\n"
+	}
+	c.SetWriteDeadline(deadline(limits.Timeouts.Write))
+	if _, err := c.Write([]byte(result)); err != nil {
+		return "", err
+	}
 
 	ConnsHandledTotal.Inc()
-	log.Debug("Server finished receiving from ", c.RemoteAddr().String(), "\n")
-
-	switch strings.TrimSpace(netData) {
-	case "":
-		// If receives nothing, keep the connection alive for a little bit before killing it
-		// otherwise will cause a "use of closed network connection error"
-		// further investigation about this issue in the future is preferable
-		// Caused by the readiness and liveness probes
-		go func() {
-			time.Sleep(time.Duration(5e9))
-			log.Debug("Waiting for 5 seconds before closing connection...")
-			c.Close()
-		}()
-	case "EOS":
-		// Packet has finished sending correctly though the desired process, safe to murder the connection
-		c.Close()
-	default:
-		// If receives data that is not the above cases (i.e. the test packet), do nothing,
-		// keep the connection alive because the EOS that follows this will terminate it
-	}
+	log.Debug("Server finished receiving from ", c.RemoteAddr().String())
+	return strings.TrimSpace(netData), nil
+}
 
-	return netData, nil
+// readLine reads from r up to and including the next newline, giving up with ErrLineTooLong rather than buffering
+// more than max bytes before it
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		part, err := r.ReadSlice('\n')
+		if len(line)+len(part) > max+1 {
+			return "", fmt.Errorf("%w: more than %v bytes", ErrLineTooLong, max)
+		}
+		line = append(line, part...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
 }
 
 // SendTCPConnections repeatedly send messages of size bytesToSend to the server
@@ -320,7 +828,7 @@ func SendTCPConnections(destHost string, nodeName string, timeBetweenTestsS floa
 
 	for {
 		log.Debug("Sending TCP test to ", destHost, "\n")
-		err := SendTCPConnection(destHost, bytesToSend, nodeName)
+		err := SendTCPConnection(context.Background(), peer.Peer{Dst: destHost, NodeName: nodeName}, bytesToSend)
 		if (err != nil) && (err != io.EOF) {
 			log.Error(err)
 			// We return the last error encountered
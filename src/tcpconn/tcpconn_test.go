@@ -1,11 +1,21 @@
 package tcpconn
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net"
+	"strings"
+	"time"
 
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/conntest/src/frame"
+	"github.com/thought-machine/conntest/src/peer"
+	"github.com/thought-machine/conntest/src/tcpconn/tcpconntest"
 )
 
 // TestOnceSmallPacketOneConn sends one small packet using one connection
@@ -137,8 +147,11 @@ func TestMultiLargePacketsSeqConn(t *testing.T) {
 	timesToSend := 20
 	maxRandTime := 0.001
 	nodeName := "TestMultiLargePacketsSeqConn"
+	// Bigger than servers accept by default
+	limits := DefaultServerLimits
+	limits.MaxRequestBytes = bytesToSend
 
-	go DealWithTCPConnections(s)
+	go DealWithTCPConnectionsWithin(s, limits)
 	err = SendTCPConnections(addr, nodeName, timeBetSend, bytesToSend, timesToSend, maxRandTime)
 	assert.Nil(t, err)
 }
@@ -190,3 +203,382 @@ func TestInvalidConn(t *testing.T) {
 	err = SendTCPConnections("some_string", nodeName, timeBetSend, bytesToSend, timesToSend, maxRandTime)
 	assert.NotNil(t, err)
 }
+
+// TestServerTCPInfo checks that the server records socket info against the identity the client said hello with
+func TestServerTCPInfo(t *testing.T) {
+	addr := "127.0.0.1:9986"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	Identity = Hello{NodeName: "TestServerTCPInfo", PodName: "conntest-abcde", Zone: "zone-a"}
+	defer func() { Identity = Hello{} }()
+
+	go DealWithTCPConnections(s)
+	err = SendTCPConnection(context.Background(), peer.Peer{Dst: addr, NodeName: "TestServerTCPInfo"}, 8)
+	assert.Nil(t, err)
+
+	mss := ServerRcvMssGaugeVec.WithLabelValues("TestServerTCPInfo", "zone-a", "127.0.0.1")
+	assert.NotZero(t, testutil.ToFloat64(mss))
+	// TCP_INFO times are in microseconds, even loopback takes more than one
+	rtt := testutil.ToFloat64(ServerRttGaugeVec.WithLabelValues("TestServerTCPInfo", "zone-a", "127.0.0.1"))
+	assert.True(t, rtt > 1e-6 && rtt < 1, rtt)
+}
+
+// TestReadTimeout checks that a server which never replies fails the test with a timeout instead of hanging it
+func TestReadTimeout(t *testing.T) {
+	addr := "127.0.0.1:9984"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go func() {
+		c, err := s.Accept()
+		if err != nil {
+			return
+		}
+		// Hold the connection open without ever answering
+		defer c.Close()
+		time.Sleep(time.Second)
+	}()
+
+	timeouts := ClientTimeouts
+	timeouts.Read = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err = SendTCPConnectionWithin(context.Background(), peer.Peer{Dst: addr, NodeName: "TestReadTimeout"}, 8, timeouts, ModeAck)
+	assert.True(t, time.Since(start) < time.Second)
+	if assert.NotNil(t, err) {
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok && netErr.Timeout(), err.Error())
+	}
+}
+
+// TestCancel checks that cancelling the context of a test interrupts it straight away
+func TestCancel(t *testing.T) {
+	addr := "127.0.0.1:9983"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go func() {
+		c, err := s.Accept()
+		if err != nil {
+			return
+		}
+		// Hold the connection open without ever answering
+		defer c.Close()
+		time.Sleep(time.Second)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = SendTCPConnection(ctx, peer.Peer{Dst: addr, NodeName: "TestCancel"}, 8)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+// TestSrcIP checks that src_ip is the address the test connection leaves from
+func TestSrcIP(t *testing.T) {
+	addr := "127.0.0.1:9982"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go DealWithTCPConnections(s)
+	err = SendTCPConnection(context.Background(), peer.Peer{Dst: addr, NodeName: "TestSrcIP"}, 8)
+	assert.Nil(t, err)
+
+	version := PeerVersionGaugeVec.WithLabelValues(peer.Peer{Dst: addr, Src: "127.0.0.1", NodeName: "TestSrcIP"}.Values()...)
+	assert.Equal(t, float64(ProtocolVersion), testutil.ToFloat64(version))
+}
+
+// TestBinaryPayload checks that payloads holding newlines and zero bytes are acknowledged once frames are negotiated
+func TestBinaryPayload(t *testing.T) {
+	addr := "127.0.0.1:9980"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go DealWithTCPConnections(s)
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	session := newSession(c, ClientTimeouts)
+	_, err = session.handshake()
+	assert.Nil(t, err)
+	assert.Nil(t, session.send([]byte("EOS\n\x00HELLO\nACK\n")))
+	assert.Nil(t, session.send([]byte{}))
+	assert.Nil(t, session.end())
+}
+
+// TestCorruptPayload checks that the server notices data that doesn't match its checksum and says what it received
+func TestCorruptPayload(t *testing.T) {
+	addr := "127.0.0.1:9977"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	Identity = Hello{NodeName: "TestCorruptPayload"}
+	defer func() { Identity = Hello{} }()
+
+	go DealWithTCPConnections(s)
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	session := newSession(c, ClientTimeouts)
+	_, err = session.handshake()
+	assert.Nil(t, err)
+	data := session.payload(100)
+	sum := frame.Checksum(data)
+	f := frame.WithChecksum(frame.TypeData, data)
+	// As a NIC would, after the checksum was computed
+	f.Payload[10] ^= 0x01
+	reply, err := session.exchange(f)
+	assert.Nil(t, err)
+	_, received, err := reply.SplitChecksum()
+	assert.Nil(t, err)
+	assert.NotEqual(t, sum, received)
+	assert.Equal(t, frame.Checksum(f.Payload[:100]), received)
+
+	corrupt := ServerCorruptPayloadsCounterVec.WithLabelValues("TestCorruptPayload", "", "127.0.0.1")
+	assert.Equal(t, 1.0, testutil.ToFloat64(corrupt))
+	assert.Nil(t, session.send(session.payload(100)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(corrupt))
+}
+
+// TestCorruptAck checks that a test fails as corrupt when the server says it received something else
+func TestCorruptAck(t *testing.T) {
+	addr := "127.0.0.1:9976"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go tcpconntest.Server{
+		Hello: Hello{Version: ProtocolVersion}.Marshal(),
+		Handle: func(c net.Conn, n int, f frame.Frame) bool {
+			// Claims to have received the data with every bit flipped
+			ack := ackOf(c, f, Hello{})
+			for i := range ack.Payload {
+				ack.Payload[i] ^= 0xff
+			}
+			return frame.Write(c, ack) == nil
+		},
+	}.Serve(s)
+
+	p := peer.Peer{Dst: addr, NodeName: "TestCorruptAck"}
+	err = SendTCPConnection(context.Background(), p, 100)
+	assert.True(t, errors.Is(err, ErrCorrupt))
+	p.Src = "127.0.0.1"
+	assert.Equal(t, 1.0, testutil.ToFloat64(CorruptPayloadsCounterVec.WithLabelValues(p.Values()...)))
+}
+
+// TestModes checks that every mode passes against our server and times the directions its data was sent in
+func TestModes(t *testing.T) {
+	addr := "127.0.0.1:9975"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go DealWithTCPConnections(s)
+	tests := []struct {
+		mode     Mode
+		upload   bool
+		download bool
+	}{
+		{ModeAck, true, false},
+		{ModeEcho, true, true},
+		{ModeServerSends, false, true},
+	}
+	for _, test := range tests {
+		p, err := SendTCPConnectionWithin(context.Background(), peer.Peer{Dst: addr, NodeName: "TestModes-" + string(test.mode)}, 100000, ClientTimeouts, test.mode)
+		assert.Nil(t, err, test.mode)
+		assert.Equal(t, "127.0.0.1", p.Src, test.mode)
+		assert.Equal(t, test.upload, testutil.ToFloat64(ThroughputGaugeVec.WithLabelValues(p.Values(directionUpload)...)) > 0, test.mode)
+		assert.Equal(t, test.download, testutil.ToFloat64(ThroughputGaugeVec.WithLabelValues(p.Values(directionDownload)...)) > 0, test.mode)
+	}
+}
+
+// TestRequestTooLarge checks that the server refuses tests bigger than its MaxRequestBytes with an ERROR, and still serves
+// those that aren't
+func TestRequestTooLarge(t *testing.T) {
+	addr := "127.0.0.1:9966"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	limits := DefaultServerLimits
+	limits.MaxRequestBytes = 1000
+	go DealWithTCPConnectionsWithin(s, limits)
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	session := newSession(c, ClientTimeouts)
+	_, err = session.handshake()
+	assert.Nil(t, err)
+	_, err = session.request(1001)
+	assert.True(t, errors.Is(err, ErrUnexpectedReply), err)
+	_, err = session.request(1000)
+	assert.Nil(t, err)
+	_, err = session.echo(session.payload(1001))
+	assert.True(t, errors.Is(err, ErrUnexpectedReply), err)
+}
+
+// TestLineTooLong checks that the server closes connections from clients without frames that send a line longer than
+// its MaxRequestBytes
+func TestLineTooLong(t *testing.T) {
+	addr := "127.0.0.1:9961"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	limits := DefaultServerLimits
+	limits.MaxRequestBytes = 1000
+	go DealWithTCPConnectionsWithin(s, limits)
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	assert.Nil(t, SendViaProtocol(c, []byte(strings.Repeat("a", 1000))))
+	assert.NotNil(t, SendViaProtocol(c, []byte(strings.Repeat("a", 10000))))
+}
+
+// TestServerReadTimeout checks that the server closes connections that stop part way through a frame
+func TestServerReadTimeout(t *testing.T) {
+	addr := "127.0.0.1:9965"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	limits := DefaultServerLimits
+	limits.Timeouts.Read = 100 * time.Millisecond
+	go DealWithTCPConnectionsWithin(s, limits)
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	session := newSession(c, ClientTimeouts)
+	_, err = session.handshake()
+	assert.Nil(t, err)
+	// A DATA frame of 10 bytes, only 2 of which are sent
+	_, err = c.Write([]byte("\x01\x00\x00\x00\x00\x0aab"))
+	assert.Nil(t, err)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = session.r.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+// TestModesLegacyServer checks that servers from before modes are sent ACK tests instead
+func TestModesLegacyServer(t *testing.T) {
+	addr := "127.0.0.1:9974"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go tcpconntest.Server{
+		Hello: Hello{Version: framesVersion}.Marshal(),
+		Handle: func(c net.Conn, n int, f frame.Frame) bool {
+			return f.Type == frame.TypeData && frame.Write(c, ackOf(c, f, Hello{})) == nil
+		},
+	}.Serve(s)
+
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	session := newSession(c, ClientTimeouts)
+	_, err = session.handshake()
+	assert.Nil(t, err)
+	transfer, err := session.test(ModeEcho, 100)
+	assert.Nil(t, err)
+	assert.NotZero(t, transfer.upload)
+	assert.Zero(t, transfer.download)
+}
+
+// TestCorruptEcho checks that data corrupted on its way back from the server is told apart from on its way there
+func TestCorruptEcho(t *testing.T) {
+	addr := "127.0.0.1:9973"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go tcpconntest.Server{
+		Hello: Hello{Version: ProtocolVersion}.Marshal(),
+		Handle: func(c net.Conn, n int, f frame.Frame) bool {
+			data, _, _ := f.SplitChecksum()
+			echo := frame.WithChecksum(frame.TypeEcho, data)
+			// After the checksum of what was received was added
+			echo.Payload[0] ^= 0x01
+			frame.Write(c, echo)
+			return false
+		},
+	}.Serve(s)
+
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	session := newSession(c, ClientTimeouts)
+	_, err = session.handshake()
+	assert.Nil(t, err)
+	_, err = session.test(ModeEcho, 100)
+	assert.True(t, errors.Is(err, ErrCorrupt))
+	assert.Contains(t, err.Error(), "echoed as")
+}
+
+// TestPersistent checks that a connection kept open can be pinged over and over, and fails once the server goes
+func TestPersistent(t *testing.T) {
+	addr := "127.0.0.1:9972"
+	s, err := net.Listen("tcp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	served := make(chan net.Conn, 1)
+	go func() {
+		c, err := s.Accept()
+		if err != nil {
+			return
+		}
+		served <- c
+		HandleTCPConnection(c)
+	}()
+
+	p := peer.Peer{Dst: addr, NodeName: "TestPersistent", TestSize: "short"}
+	conn, err := DialPersistent(context.Background(), p, ClientTimeouts)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Equal(t, "", conn.Peer().TestSize)
+	assert.Equal(t, "127.0.0.1", conn.Peer().Src)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, conn.Ping(context.Background()))
+	}
+	assert.True(t, testutil.ToFloat64(ConnectionAgeGaugeVec.WithLabelValues(conn.Peer().Values()...)) > 0)
+
+	(<-served).Close()
+	assert.NotNil(t, conn.Ping(context.Background()))
+}
+
+// TestIncrease checks that counts from TCP_INFO only add what they went up by since the last sample
+func TestIncrease(t *testing.T) {
+	assert.Equal(t, 0.0, increase(5, 5))
+	assert.Equal(t, 3.0, increase(8, 5))
+	assert.Equal(t, 0.0, increase(2, 5))
+}
@@ -0,0 +1,53 @@
+package tcpconntest
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/thought-machine/conntest/src/frame"
+)
+
+// Server is a fake conntest server for tests, which says hello and then answers frames however the test wants
+type Server struct {
+	// What to answer the client's HELLO line with, without the newline
+	Hello []byte
+	// Accept is called with every connection before it is served, and hangs up on it by returning false. Optional
+	Accept func(c net.Conn) bool
+	// Handle answers the frame f, the n'th the client sent on c counting from 0, and returns whether to carry on
+	// serving c
+	Handle func(c net.Conn, n int, f frame.Frame) bool
+}
+
+// Serve serves every connection accepted from s on its own goroutine, until s is closed
+func (srv Server) Serve(s net.Listener) {
+	for {
+		c, err := s.Accept()
+		if err != nil {
+			return
+		}
+		if srv.Accept != nil && !srv.Accept(c) {
+			c.Close()
+			continue
+		}
+		go srv.serve(c)
+	}
+}
+
+// serve says hello to c and hands it every frame the client sends, until Handle or the client is done with it
+func (srv Server) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	if _, err := r.ReadString('\n'); err != nil {
+		return
+	}
+	if _, err := c.Write(append(append([]byte{}, srv.Hello...), '\n')); err != nil {
+		return
+	}
+	frames := frame.NewReader(r)
+	for n := 0; ; n++ {
+		f, err := frames.Read()
+		if err != nil || !srv.Handle(c, n, f) {
+			return
+		}
+	}
+}
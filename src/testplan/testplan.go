@@ -0,0 +1,66 @@
+package testplan
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// Values of the test_size label
+const (
+	Short = "short"
+	Long  = "long"
+)
+
+// Test is one cycle of tests, sending Bytes bytes to every peer
+type Test struct {
+	// Short or Long
+	Size  string
+	Bytes int
+}
+
+// Plan decides what size of test each cycle sends, small payloads keep the probe cheap but only large ones
+// run into MTU black holes
+type Plan struct {
+	ShortBytes int
+	LongBytes  int
+	// Every LongEvery-th cycle sends a long test instead of a short one, 0 only sends short tests
+	LongEvery int
+	cycle     int
+}
+
+// Next returns the test to send in the next cycle
+func (p *Plan) Next() Test {
+	p.cycle++
+	if p.LongEvery > 0 && p.cycle%p.LongEvery == 0 {
+		return Test{Size: Long, Bytes: p.LongBytes}
+	}
+	return Test{Size: Short, Bytes: p.ShortBytes}
+}
+
+// Run sends cycles tests of the plan using send, or keeps sending forever if cycles is 0, pausing for as long as wait
+// says between them. It stops once ctx is done, without interrupting a test in flight.
+// Failed tests are logged rather than stopping the plan
+func (p *Plan) Run(ctx context.Context, cycles int, send func(Test) error, wait func() time.Duration) {
+	for i := 0; cycles == 0 || i < cycles; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait()):
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		test := p.Next()
+		log.Debug("Sending ", test.Size, " test of ", test.Bytes, " bytes")
+		err := send(test)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package testplan
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAlternate checks that a LongEvery of 2 alternates short and long tests
+func TestAlternate(t *testing.T) {
+	p := &Plan{ShortBytes: 10, LongBytes: 10000, LongEvery: 2}
+	assert.Equal(t, Test{Size: Short, Bytes: 10}, p.Next())
+	assert.Equal(t, Test{Size: Long, Bytes: 10000}, p.Next())
+	assert.Equal(t, Test{Size: Short, Bytes: 10}, p.Next())
+	assert.Equal(t, Test{Size: Long, Bytes: 10000}, p.Next())
+}
+
+// TestRatio checks that only every LongEvery-th test is long, and none are when it is 0
+func TestRatio(t *testing.T) {
+	p := &Plan{ShortBytes: 10, LongBytes: 10000, LongEvery: 3}
+	var sizes []string
+	for i := 0; i < 6; i++ {
+		sizes = append(sizes, p.Next().Size)
+	}
+	assert.Equal(t, []string{Short, Short, Long, Short, Short, Long}, sizes)
+
+	p = &Plan{ShortBytes: 10, LongBytes: 10000}
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, Short, p.Next().Size)
+	}
+}
+
+// TestRun checks that Run sends the number of cycles asked for, waiting only between them and carrying on past errors
+func TestRun(t *testing.T) {
+	p := &Plan{ShortBytes: 10, LongBytes: 10000, LongEvery: 2}
+	var sent []int
+	waits := 0
+	p.Run(context.Background(), 3, func(test Test) error {
+		sent = append(sent, test.Bytes)
+		return errors.New("Failed")
+	}, func() time.Duration {
+		waits++
+		return time.Millisecond
+	})
+	assert.Equal(t, []int{10, 10000, 10}, sent)
+	assert.Equal(t, 2, waits)
+}
+
+// TestRunCancelled checks that Run stops sending once its context is cancelled, even when sending forever
+func TestRunCancelled(t *testing.T) {
+	p := &Plan{ShortBytes: 10, LongBytes: 10000, LongEvery: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	sent := 0
+	p.Run(ctx, 0, func(test Test) error {
+		sent++
+		cancel()
+		return nil
+	}, func() time.Duration { return time.Hour })
+	assert.Equal(t, 1, sent)
+
+	p.Run(ctx, 0, func(test Test) error {
+		sent++
+		return nil
+	}, func() time.Duration { return 0 })
+	assert.Equal(t, 1, sent)
+}
@@ -0,0 +1,276 @@
+package udpconn
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/thought-machine/conntest/src/peer"
+)
+
+var log = logrus.New()
+
+// Every datagram starts with a fixed header:
+// magic (2 bytes) | type (1 byte) | flags (1 byte) | sequence number (4 bytes) | send time in unix nanoseconds (8 bytes)
+// followed by padding up to the requested size
+const (
+	HeaderSize = 16
+	magic      = 0x4354 // "CT"
+)
+
+// Datagram types
+const (
+	// TypeProbe is echoed back in full by the responder
+	TypeProbe byte = 1
+	// TypePMTU is answered with only its header, so that the reply fits through any path
+	TypePMTU byte = 2
+)
+
+// How long the sender waits for echoes after the last datagram was sent
+const replyTimeout = time.Second
+
+// ErrNoEchoes is returned when not a single datagram sent to a peer came back before replyTimeout
+var ErrNoEchoes = errors.New("No echoes received")
+
+// Set up simple server side metrics to be exported
+var (
+	// Total number of datagrams echoed by the responder
+	PacketsHandledTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "conntest_udp_packets_handled_total",
+		},
+	)
+)
+
+// Set up per peer statistics as metrics
+var (
+	LossGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_udp_loss_percentage_gauge",
+		},
+		peer.Labels(),
+	)
+
+	DuplicatesCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conntest_udp_duplicates_counter",
+		},
+		peer.Labels(),
+	)
+
+	ReorderedCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conntest_udp_reordered_counter",
+		},
+		peer.Labels(),
+	)
+
+	JitterGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "conntest_udp_jitter_seconds_gauge",
+		},
+		peer.Labels(),
+	)
+
+	RttHistVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "conntest_udp_round_trip_time_seconds_hist",
+			Buckets: peer.LatencyBuckets,
+		},
+		peer.Labels(),
+	)
+)
+
+// Header is the decoded start of a datagram
+type Header struct {
+	Type     byte
+	Flags    byte
+	Seq      uint32
+	SentTime time.Time
+}
+
+// Marshal writes h into the start of buf, which must be at least HeaderSize long
+func (h Header) Marshal(buf []byte) {
+	binary.BigEndian.PutUint16(buf[0:2], magic)
+	buf[2] = h.Type
+	buf[3] = h.Flags
+	binary.BigEndian.PutUint32(buf[4:8], h.Seq)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(h.SentTime.UnixNano()))
+}
+
+// ParseHeader decodes the header at the start of buf
+func ParseHeader(buf []byte) (Header, error) {
+	if len(buf) < HeaderSize || binary.BigEndian.Uint16(buf[0:2]) != magic {
+		return Header{}, errors.New("Not a conntest datagram")
+	}
+	return Header{
+		Type:     buf[2],
+		Flags:    buf[3],
+		Seq:      binary.BigEndian.Uint32(buf[4:8]),
+		SentTime: time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:16]))),
+	}, nil
+}
+
+// Stats accumulates what was seen of the echoes of one run of probes
+type Stats struct {
+	Sent       int
+	Received   int
+	Duplicates int
+	Reordered  int
+	// Interarrival jitter as defined in RFC 3550, computed from round trip times
+	Jitter time.Duration
+
+	seen        map[uint32]bool
+	highestSeq  uint32
+	lastTransit time.Duration
+}
+
+// NewStats returns Stats for sent datagrams
+func NewStats(sent int) *Stats {
+	return &Stats{Sent: sent, seen: make(map[uint32]bool)}
+}
+
+// Record accounts for the echo of datagram seq, sent and received at the given times
+func (s *Stats) Record(seq uint32, sent time.Time, received time.Time) {
+	if s.seen[seq] {
+		s.Duplicates++
+		return
+	}
+	transit := received.Sub(sent)
+	if s.Received > 0 {
+		if seq < s.highestSeq {
+			s.Reordered++
+		}
+		d := transit - s.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		s.Jitter += (d - s.Jitter) / 16
+	}
+	if seq > s.highestSeq {
+		s.highestSeq = seq
+	}
+	s.seen[seq] = true
+	s.lastTransit = transit
+	s.Received++
+}
+
+// LossPercentage is the percentage of sent datagrams that never came back
+func (s *Stats) LossPercentage() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return 100 * math.Max(0, float64(s.Sent-s.Received)) / float64(s.Sent)
+}
+
+// DealWithUDPConnections echoes every conntest datagram received on c back to its sender, PMTU probes are truncated to their header
+func DealWithUDPConnections(c net.PacketConn) error {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			log.Debug("Error reading datagram: ", err)
+			return err
+		}
+		h, err := ParseHeader(buf[:n])
+		if err != nil {
+			log.Debug("Ignoring datagram from ", addr, ": ", err)
+			continue
+		}
+		if h.Type == TypePMTU {
+			n = HeaderSize
+		}
+		_, err = c.WriteTo(buf[:n], addr)
+		if err != nil {
+			log.Debug("Error echoing datagram to ", addr, ": ", err)
+			continue
+		}
+		PacketsHandledTotal.Inc()
+	}
+}
+
+// SendUDPProbes sends count datagrams of bytesToSend bytes to p.Dst, interval apart, and records loss,
+// duplication, reordering and jitter of the echoes. Sending stops as soon as ctx is done, without recording anything.
+// It returns p with the source address filled in
+func SendUDPProbes(ctx context.Context, p peer.Peer, bytesToSend int, count int, interval time.Duration) (peer.Peer, error) {
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, "udp", p.Dst)
+	if err != nil {
+		return p, err
+	}
+	defer c.Close()
+	defer log.Debug("Client finished sending to ", p.Dst)
+	p.Src = c.LocalAddr().(*net.UDPAddr).IP.String()
+
+	if bytesToSend < HeaderSize {
+		bytesToSend = HeaderSize
+	}
+	stats := NewStats(count)
+
+	// Echoes are collected while sending so that reordering is seen as it happens
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 65536)
+		for {
+			n, err := c.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return
+			}
+			if err != nil {
+				// ICMP errors such as port unreachable surface here, the datagram just counts as lost
+				log.Debug("Error receiving from ", p.Dst, ": ", err)
+				continue
+			}
+			received := time.Now()
+			h, err := ParseHeader(buf[:n])
+			if err != nil || h.Type != TypeProbe {
+				continue
+			}
+			stats.Record(h.Seq, h.SentTime, received)
+			RttHistVec.WithLabelValues(p.Values()...).Observe(received.Sub(h.SentTime).Seconds())
+			if stats.Received == count {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, bytesToSend)
+	for i := 0; i < count; i++ {
+		Header{Type: TypeProbe, Seq: uint32(i), SentTime: time.Now()}.Marshal(buf)
+		_, err = c.Write(buf)
+		if err != nil {
+			// Refused datagrams are reported asynchronously, so carry on and count them as lost
+			log.Debug("Error sending datagram to ", p.Dst, ": ", err)
+		}
+		if i == count-1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			c.SetReadDeadline(time.Now())
+			<-done
+			return p, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	c.SetReadDeadline(time.Now().Add(replyTimeout))
+	<-done
+
+	log.Debug("UDP stats for ", p.Dst, ": ", *stats)
+	LossGaugeVec.WithLabelValues(p.Values()...).Set(stats.LossPercentage())
+	DuplicatesCounterVec.WithLabelValues(p.Values()...).Add(float64(stats.Duplicates))
+	ReorderedCounterVec.WithLabelValues(p.Values()...).Add(float64(stats.Reordered))
+	JitterGaugeVec.WithLabelValues(p.Values()...).Set(stats.Jitter.Seconds())
+	if count > 0 && stats.Received == 0 {
+		return p, fmt.Errorf("%w from %v", ErrNoEchoes, p.Dst)
+	}
+	return p, nil
+}
@@ -0,0 +1,70 @@
+package udpconn
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/conntest/src/peer"
+)
+
+// TestHeaderRoundTrip checks that a marshalled header parses back to the same values
+func TestHeaderRoundTrip(t *testing.T) {
+	buf := make([]byte, HeaderSize)
+	h := Header{Type: TypeProbe, Flags: 3, Seq: 42, SentTime: time.Unix(0, 1234567890)}
+	h.Marshal(buf)
+
+	parsed, err := ParseHeader(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, h.Seq, parsed.Seq)
+	assert.Equal(t, h.Flags, parsed.Flags)
+	assert.True(t, h.SentTime.Equal(parsed.SentTime))
+
+	_, err = ParseHeader([]byte("aaaaaaaaaaaaaaaaaaaa"))
+	assert.NotNil(t, err)
+}
+
+// TestStats feeds a lossy, duplicated and reordered sequence of echoes through Stats
+func TestStats(t *testing.T) {
+	start := time.Now()
+	ms := time.Millisecond
+	stats := NewStats(5)
+
+	stats.Record(0, start, start.Add(10*ms))
+	stats.Record(2, start, start.Add(12*ms))
+	stats.Record(1, start, start.Add(10*ms))
+	stats.Record(1, start, start.Add(10*ms))
+
+	assert.Equal(t, 3, stats.Received)
+	assert.Equal(t, 1, stats.Duplicates)
+	assert.Equal(t, 1, stats.Reordered)
+	assert.Equal(t, 40.0, stats.LossPercentage())
+	// Two transit differences of 2ms each
+	expected := 2 * ms / 16
+	expected += (2*ms - expected) / 16
+	assert.Equal(t, expected, stats.Jitter)
+}
+
+// TestSendUDPProbes sends probes to a local responder and expects every one of them back
+func TestSendUDPProbes(t *testing.T) {
+	addr := "127.0.0.1:9969"
+	s, err := net.ListenPacket("udp", addr)
+
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go DealWithUDPConnections(s)
+	p, err := SendUDPProbes(context.Background(), peer.Peer{Dst: addr, NodeName: "TestSendUDPProbes"}, 100, 50, time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", p.Src)
+}
+
+// TestNoResponder checks that an error is returned when nothing echoes the probes
+func TestNoResponder(t *testing.T) {
+	_, err := SendUDPProbes(context.Background(), peer.Peer{Dst: "127.0.0.1:9968", NodeName: "TestNoResponder"}, 100, 5, time.Millisecond)
+	assert.NotNil(t, err)
+}